@@ -0,0 +1,583 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// openedFile is everything needed to read or append to one file.
+type openedFile struct {
+	NodeKey         []byte
+	Node            UserFileNode
+	LastChunk       ChunkPointer
+	StoredLastChunk []byte
+}
+
+// createdFile is a new file whose blobs are prepared but whose NodeKey has
+// not been published yet.
+type createdFile struct {
+	NodeKeyUuid   uuid.UUID
+	StoredNodeKey []byte
+	Blobs         []uuid.UUID
+}
+
+// StoreFiles is StoreFile for many files at once. Every phase (NodeKeys,
+// nodes, pointers, chunks) is one batched Datastore round trip for all the
+// files together. errs has an entry for each file that could not be stored;
+// the others were stored even if some failed.
+func (userdata *User) StoreFiles(files map[string][]byte) (errs map[string]error) {
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+
+	unlock := userdata.lockFiles(filenames, false)
+	defer unlock()
+
+	errs = make(map[string]error)
+	pending := filenames
+	for attempt := 0; attempt < maxRetries && len(pending) > 0; attempt++ {
+		pending = userdata.storeFilesOnce(files, pending, errs)
+	}
+	for _, filename := range pending {
+		errs[filename] = ErrConflict
+	}
+	return errs
+}
+
+// LoadFiles is LoadFile for many files at once. The files' chunk chains are
+// walked in lockstep, one batched fetch per step. errs has an entry for each
+// file that could not be loaded.
+func (userdata *User) LoadFiles(filenames []string) (contents map[string][]byte, errs map[string]error) {
+	contents, errs, pending := userdata.loadFiles(filenames)
+
+	// the load itself succeeded, a rotation that fails is retried on the
+	// next access
+	if len(pending) > 0 {
+		userdata.rekeyFiles(pending)
+	}
+	return contents, errs
+}
+
+// loadFiles does the work of LoadFiles under shared locks, and returns the
+// files whose keys the caller has to rotate afterwards.
+func (userdata *User) loadFiles(filenames []string) (contents map[string][]byte, errs map[string]error, pending []string) {
+	unlock := userdata.lockFiles(filenames, true)
+	defer unlock()
+
+	opened, missing, errs := userdata.openFiles(filenames)
+	for _, filename := range missing {
+		errs[filename] = errors.New(filename + "not in users'namespace")
+	}
+
+	contents, chainErrs := loadChains(opened, userdata.getCache())
+	for filename, err := range chainErrs {
+		errs[filename] = err
+	}
+
+	for filename, file := range opened {
+		if userdata.rekeyPending(file) {
+			pending = append(pending, filename)
+		}
+	}
+	return contents, errs, pending
+}
+
+// rekeyFiles rotates the keys of the files whose rotation is still pending
+// once their locks are held exclusively.
+func (userdata *User) rekeyFiles(filenames []string) {
+	unlock := userdata.lockFiles(filenames, false)
+	defer unlock()
+
+	opened, _, _ := userdata.openFiles(filenames)
+	for filename, file := range opened {
+		if userdata.rekeyPending(file) {
+			userdata.rekey(filename, file)
+		}
+	}
+}
+
+// storeFilesOnce makes one attempt at storing every pending file, as a
+// single journal entry, and returns the files that lost a race to another
+// session.
+func (userdata *User) storeFilesOnce(files map[string][]byte, pending []string, errs map[string]error) (conflicts []string) {
+	opened, missing, openErrs := userdata.openFiles(pending)
+	for filename, err := range openErrs {
+		errs[filename] = err
+	}
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+	var swapped []string
+
+	for filename, file := range opened {
+		due, err := userdata.rekeyDue(file)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+		if due {
+			err = userdata.rekey(filename, file)
+			if err != nil {
+				errs[filename] = err
+				continue
+			}
+			conflicts = append(conflicts, filename)
+			continue
+		}
+
+		err = file.Node.require(PermWrite)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		chunkUuid := uuid.New()
+		storable_chunk, pointer, err := EncryptChunk(FileChunk{files[filename], uuid.Nil, nil}, chunkUuid, file.Node.FileKey)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+		pointer.Size = sizeBytes(len(files[filename]))
+		pointer.Rekey = file.LastChunk.Rekey
+
+		err = file.Node.signPointer(&pointer)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		storable_lastChunk, err := MarshalAuthEnc(pointer, file.Node.FileKey)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		entry.Sets[chunkUuid] = storable_chunk
+		entry.Swaps = append(entry.Swaps, journalSwap{Key: file.Node.LastChunkUuid, Old: file.StoredLastChunk, New: storable_lastChunk, Undo: []uuid.UUID{chunkUuid}})
+		swapped = append(swapped, filename)
+	}
+
+	created := make(map[string]uuid.UUID)
+	for _, filename := range missing {
+		file, err := userdata.prepareFile(filename, files[filename], entry.Sets)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		// publishing the NodeKey last means another session never sees a
+		// half-created file
+		entry.Swaps = append(entry.Swaps, journalSwap{Key: file.NodeKeyUuid, New: file.StoredNodeKey, Undo: file.Blobs})
+		swapped = append(swapped, filename)
+		created[filename] = file.NodeKeyUuid
+	}
+
+	if len(swapped) == 0 {
+		return conflicts
+	}
+
+	lost, err := userdata.commitIndexed(entry, created)
+	if err != nil {
+		for _, filename := range swapped {
+			errs[filename] = err
+		}
+		return nil
+	}
+
+	// a lost NodeKey means another session created the file first, so the
+	// next round overwrites theirs instead
+	for _, i := range lost {
+		conflicts = append(conflicts, swapped[i])
+	}
+
+	cache := userdata.getCache()
+	for filename := range created {
+		cache.forget(filename)
+	}
+
+	return conflicts
+}
+
+// prepareFile adds the ShareMap, UserFileNode, owner record, chunk and
+// pointer of a new file to blobs, under a fresh NodeKey.
+func (userdata *User) prepareFile(filename string, content []byte, blobs map[uuid.UUID][]byte) (file createdFile, err error) {
+	var node UserFileNode
+
+	NodeKey := userlib.RandomBytes(16)
+
+	node.LastChunkUuid = uuid.New()
+	node.FileKey = userlib.RandomBytes(16)
+	node.Perms = PermAll
+
+	err = node.newWriteKeys()
+	if err != nil {
+		return file, err
+	}
+
+	record, err := userdata.newOwnerRecord()
+	if err != nil {
+		return file, err
+	}
+
+	sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
+	if err != nil {
+		return file, err
+	}
+
+	nodeUuid, err := DeriveUuid(NodeKey, "UserFileNode")
+	if err != nil {
+		return file, err
+	}
+
+	recordUuid, err := DeriveUuid(NodeKey, "OwnerRecord")
+	if err != nil {
+		return file, err
+	}
+
+	seenUuid, err := seenUuid(NodeKey)
+	if err != nil {
+		return file, err
+	}
+
+	chunkUuid := uuid.New()
+
+	storable_chunk, pointer, err := EncryptChunk(FileChunk{content, uuid.Nil, nil}, chunkUuid, node.FileKey)
+	if err != nil {
+		return file, err
+	}
+	pointer.Size = sizeBytes(len(content))
+
+	err = node.signPointer(&pointer)
+	if err != nil {
+		return file, err
+	}
+	blobs[chunkUuid] = storable_chunk
+	file.Blobs = append(file.Blobs, chunkUuid)
+
+	entries := []struct {
+		blobUuid uuid.UUID
+		data     any
+		key      []byte
+	}{
+		{sharedToUuid, make(ShareMap), NodeKey},
+		{nodeUuid, node, NodeKey},
+		{recordUuid, record, NodeKey},
+		{seenUuid, make(map[string]int), NodeKey},
+		{node.LastChunkUuid, pointer, node.FileKey},
+	}
+	for _, entry := range entries {
+		storable, err := MarshalAuthEnc(entry.data, entry.key)
+		if err != nil {
+			return file, err
+		}
+		blobs[entry.blobUuid] = storable
+		file.Blobs = append(file.Blobs, entry.blobUuid)
+	}
+
+	file.NodeKeyUuid, err = userdata.reserveSlot(filename)
+	if err != nil {
+		return file, err
+	}
+
+	file.StoredNodeKey, err = AuthEnc(userdata.FilenameKey, NodeKey)
+	if err != nil {
+		return file, err
+	}
+
+	return file, nil
+}
+
+// openFile is openFiles for a single file.
+func (userdata *User) openFile(filename string) (file openedFile, err error) {
+	opened, missing, errs := userdata.openFiles([]string{filename})
+	if len(missing) > 0 {
+		return file, errors.New(filename + "not in users'namespace")
+	}
+	if errs[filename] != nil {
+		return file, errs[filename]
+	}
+	return opened[filename], nil
+}
+
+// openFiles fetches the NodeKey, node and pointer of every file, each kind
+// in one batch. Cached nodes are revalidated by their pointer alone; if the
+// pointer is gone the file was re-keyed and is fetched again from its
+// NodeKey. Files with no NodeKey are returned in missing.
+func (userdata *User) openFiles(filenames []string) (opened map[string]openedFile, missing []string, errs map[string]error) {
+	cache := userdata.getCache()
+
+	opened = make(map[string]openedFile)
+	errs = make(map[string]error)
+	nodes := make(map[string]cachedFile)
+
+	var cached, fresh []string
+	for _, filename := range filenames {
+		if entry, ok := cache.file(filename); ok {
+			nodes[filename] = entry
+			cached = append(cached, filename)
+		} else {
+			fresh = append(fresh, filename)
+		}
+	}
+
+	for filename := range fetchLastChunks(cached, nodes, opened) {
+		cache.forget(filename)
+		fresh = append(fresh, filename)
+	}
+
+	// files reached through a group are resolved on every access, for a
+	// member removed from it to lose access at once
+	uncached := make(map[string]bool)
+
+	NodeKeyUuids, stored_NodeKeys, err := userdata.getSlots(fresh)
+	if err != nil {
+		for _, filename := range fresh {
+			errs[filename] = err
+		}
+		NodeKeyUuids = nil
+	}
+
+	nodeUuids := make(map[string]uuid.UUID)
+	keys := make([]uuid.UUID, 0, len(fresh))
+	for filename, NodeKeyUuid := range NodeKeyUuids {
+		stored_NodeKey, ok := stored_NodeKeys[NodeKeyUuid]
+		if !ok {
+			missing = append(missing, filename)
+			continue
+		}
+
+		stored, err := AuthDec(userdata.FilenameKey, stored_NodeKey)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		NodeKey, viaGroup, err := userdata.resolveNodeKey(stored)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+		if viaGroup {
+			uncached[filename] = true
+		}
+
+		nodeUuid, err := DeriveUuid(NodeKey, "UserFileNode")
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		nodes[filename] = cachedFile{NodeKey: NodeKey}
+		nodeUuids[filename] = nodeUuid
+		keys = append(keys, nodeUuid)
+	}
+	stored_nodes := getMany(keys)
+
+	var found []string
+	for filename, nodeUuid := range nodeUuids {
+		stored_node, ok := stored_nodes[nodeUuid]
+		if !ok {
+			errs[filename] = errors.New("Node missing")
+			continue
+		}
+
+		entry := nodes[filename]
+		err := UnmarshalAuthDec(entry.NodeKey, stored_node, &entry.Node)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+		nodes[filename] = entry
+		found = append(found, filename)
+	}
+
+	for filename, err := range fetchLastChunks(found, nodes, opened) {
+		errs[filename] = err
+	}
+	for _, filename := range found {
+		if _, ok := opened[filename]; ok && !uncached[filename] {
+			cache.setFile(filename, nodes[filename].NodeKey, nodes[filename].Node)
+		}
+	}
+
+	return opened, missing, errs
+}
+
+// fetchLastChunks fetches the pointers of the named nodes in one batch,
+// adding each file whose pointer decrypts to opened.
+func fetchLastChunks(filenames []string, nodes map[string]cachedFile, opened map[string]openedFile) (errs map[string]error) {
+	errs = make(map[string]error)
+	if len(filenames) == 0 {
+		return errs
+	}
+
+	keys := make([]uuid.UUID, 0, len(filenames))
+	for _, filename := range filenames {
+		keys = append(keys, nodes[filename].Node.LastChunkUuid)
+	}
+	stored_lastChunks := getMany(keys)
+
+	for _, filename := range filenames {
+		entry := nodes[filename]
+
+		stored_lastChunk, ok := stored_lastChunks[entry.Node.LastChunkUuid]
+		if !ok {
+			errs[filename] = errors.New("lastChunkuuid is gone")
+			continue
+		}
+
+		var lastChunk ChunkPointer
+		err := UnmarshalAuthDec(entry.Node.FileKey, stored_lastChunk, &lastChunk)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		err = entry.Node.verifyPointer(lastChunk)
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		opened[filename] = openedFile{entry.NodeKey, entry.Node, lastChunk, stored_lastChunk}
+	}
+	return errs
+}
+
+// loadChains walks the chunk chains of all opened files together, one
+// batched fetch per step, and assembles each file into a fresh slice.
+// Chunks still under an old key are written back re-encrypted, and once a
+// whole chain has been read from the Datastore that way the file's key ring
+// is no longer needed.
+func loadChains(opened map[string]openedFile, cache *fileCache) (contents map[string][]byte, errs map[string]error) {
+	contents = make(map[string][]byte)
+	errs = make(map[string]error)
+
+	walks := make(map[string]*chainWalk)
+	active := make(map[string]*chainWalk)
+	for filename, file := range opened {
+		walks[filename] = newChainWalk(file.Node.FileKey, file.LastChunk)
+		active[filename] = walks[filename]
+	}
+
+	reencrypted := make(map[uuid.UUID][]byte)
+
+	for len(active) > 0 {
+		keys := make([]uuid.UUID, 0, len(active))
+		for filename, walk := range active {
+			for !walk.done() {
+				chunk, ok := cache.chunk(walk.next.Chunk)
+				if !ok {
+					break
+				}
+				walk.add(chunk)
+				walk.cached = true
+			}
+
+			if walk.done() {
+				delete(active, filename)
+				continue
+			}
+			keys = append(keys, walk.next.Chunk)
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		stored_chunks := getMany(keys)
+		for filename, walk := range active {
+			chunkUuid := walk.next.Chunk
+
+			stored_chunk, ok := stored_chunks[chunkUuid]
+			if !ok {
+				errs[filename] = errors.New("missing chunk")
+				delete(active, filename)
+				continue
+			}
+
+			chunk, storable_chunk, err := walk.open(stored_chunk)
+			if err != nil {
+				errs[filename] = err
+				delete(active, filename)
+				continue
+			}
+			if storable_chunk != nil {
+				reencrypted[chunkUuid] = storable_chunk
+			}
+			cache.setChunk(chunkUuid, chunk)
+
+			walk.add(chunk)
+			if walk.done() {
+				delete(active, filename)
+			}
+		}
+	}
+
+	if len(reencrypted) > 0 {
+		setMany(reencrypted)
+	}
+
+	for filename, walk := range walks {
+		if errs[filename] != nil {
+			continue
+		}
+		if !walk.reached {
+			errs[filename] = errors.New("chunks a writer stored were replaced by an appender")
+			continue
+		}
+
+		if len(walk.ring) > 0 && !walk.cached {
+			ringUuid, err := DeriveUuid(walk.fileKey, "KeyRing")
+			if err == nil {
+				store.Delete(ringUuid)
+			}
+		}
+
+		size := 0
+		for _, piece := range walk.pieces {
+			size += len(piece)
+		}
+
+		content := make([]byte, 0, size)
+		for i := len(walk.pieces) - 1; i >= 0; i-- {
+			content = append(content, walk.pieces[i]...)
+		}
+		contents[filename] = content
+	}
+	return contents, errs
+}
+
+// lockFiles takes the session locks of filenames in sorted order, so that
+// overlapping batches cannot deadlock, and returns a function releasing them.
+func (userdata *User) lockFiles(filenames []string, shared bool) (unlock func()) {
+	sorted := append([]string{}, filenames...)
+	sort.Strings(sorted)
+
+	var locks []*sync.RWMutex
+	for i, filename := range sorted {
+		if i > 0 && filename == sorted[i-1] {
+			continue
+		}
+		lock := userdata.fileLock(filename)
+		if shared {
+			lock.RLock()
+		} else {
+			lock.Lock()
+		}
+		locks = append(locks, lock)
+	}
+
+	return func() {
+		for _, lock := range locks {
+			if shared {
+				lock.RUnlock()
+			} else {
+				lock.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// fileCache holds decrypted metadata for one session. NodeKeys and nodes
+// are only trusted until the pointer they lead to disappears (the file was
+// re-keyed by a revocation); chunks are immutable once written, so they
+// never go stale. A nil *fileCache is a valid, always-empty cache.
+type fileCache struct {
+	mu     sync.Mutex
+	files  map[string]cachedFile
+	chunks map[uuid.UUID]FileChunk
+}
+
+type cachedFile struct {
+	NodeKey []byte
+	Node    UserFileNode
+}
+
+// SetCaching turns the session's metadata and chunk cache on or off. With
+// caching on, loading an unchanged file costs a single pointer fetch, and
+// loading an appended-to file only fetches the new chunks. Turning caching
+// off drops everything cached so far.
+func (userdata *User) SetCaching(enabled bool) {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+
+	if !enabled {
+		userdata.cache = nil
+	} else if userdata.cache == nil {
+		userdata.cache = &fileCache{
+			files:  make(map[string]cachedFile),
+			chunks: make(map[uuid.UUID]FileChunk),
+		}
+	}
+}
+
+func (userdata *User) getCache() *fileCache {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+	return userdata.cache
+}
+
+func (c *fileCache) file(filename string) (entry cachedFile, ok bool) {
+	if c == nil {
+		return entry, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok = c.files[filename]
+	return entry, ok
+}
+
+func (c *fileCache) setFile(filename string, NodeKey []byte, node UserFileNode) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[filename] = cachedFile{NodeKey, node}
+}
+
+func (c *fileCache) forget(filename string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.files, filename)
+}
+
+func (c *fileCache) chunk(chunkUuid uuid.UUID) (chunk FileChunk, ok bool) {
+	if c == nil {
+		return chunk, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chunk, ok = c.chunks[chunkUuid]
+	return chunk, ok
+}
+
+func (c *fileCache) setChunk(chunkUuid uuid.UUID, chunk FileChunk) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chunks[chunkUuid] = chunk
+}
@@ -12,10 +12,15 @@ package client
 // - github.com/cs161-staff/project2-userlib
 // - github.com/google/uuid
 // - strconv
+// - sort
 // - strings
+// - sync
+// - time
 
 import (
+	"bytes"
 	"encoding/json"
+	"sync"
 
 	userlib "github.com/cs161-staff/project2-userlib"
 	"github.com/google/uuid"
@@ -107,11 +112,52 @@ func someUsefulThings() {
 // This is the type definition for the User struct.
 // A Go struct is like a Python or Java class - it can have attributes
 // (e.g. like the Username attribute) and methods (e.g. like the StoreFile method below).
+//
+// A *User is safe for use by multiple goroutines. Operations on the same
+// filename are serialized within a session (LoadFile calls may overlap each
+// other), operations on different filenames run in parallel, and sessions
+// on other devices are kept consistent by the compare-and-swap in Storage.
 type User struct {
+	Username      string
 	Username_hash []byte
 	FilenameKey   []byte
 	DecKey        userlib.PKEDecKey
 	SignKey       userlib.DSSignKey
+	KeyVersion    int
+	OldDecKeys    []userlib.PKEDecKey
+
+	// set while RotateKeys is in progress
+	NextKeys *pendingKeys
+
+	// set while RotateKeys signs again what the old keys signed
+	Resign bool
+
+	// set while RotateFilenameKey is in progress
+	NextFilenameKey []byte
+	PrevFilenameKey []byte
+
+	// set by EnableRandomNodeKeyLocations
+	RandomNodeKeys bool
+
+	// set once every filename in the namespace is in the filename index,
+	// which is from InitUser on for users made since it exists
+	Indexed bool
+
+	userKey []byte
+
+	// the User struct as this session last read or stored it
+	storedUser []byte
+
+	// this session's copy of the filename index, with random NodeKey
+	// locations
+	slots map[string]uuid.UUID
+
+	// identifies this session's entries in the journal
+	session uuid.UUID
+
+	mu        sync.Mutex
+	fileLocks map[string]*sync.RWMutex
+	cache     *fileCache
 
 	// You can add other attributes here if you want! But note that in order for attributes to
 	// be included when this struct is serialized to/from JSON, they must be capitalized.
@@ -121,14 +167,57 @@ type User struct {
 	// begins with a lowercase letter).
 }
 
+// fileLock returns the lock guarding filename within this session.
+func (userdata *User) fileLock(filename string) *sync.RWMutex {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+
+	if userdata.fileLocks == nil {
+		userdata.fileLocks = make(map[string]*sync.RWMutex)
+	}
+	lock, ok := userdata.fileLocks[filename]
+	if !ok {
+		lock = new(sync.RWMutex)
+		userdata.fileLocks[filename] = lock
+	}
+	return lock
+}
+
 type UserFileNode struct {
 	LastChunkUuid uuid.UUID //should never change unless revoked
 	FileKey       []byte
+	Perms         Permission
+	VerifyKey     []byte
+	WriteKey      []byte // only with PermWrite
+
+	AppendVerifyKey []byte
+	AppendKey       []byte // only with PermAppend
 }
 
 type FileChunk struct {
-	Content []byte
-	Prev    uuid.UUID
+	Content  []byte
+	Prev     uuid.UUID
+	PrevHash []byte
+}
+
+// ChunkPointer is what node.LastChunkUuid holds: the last chunk and the
+// hash of its plaintext. Every chunk records the hash of the one before it
+// the same way, so the pointer authenticates the whole chain, whichever key
+// each chunk is currently encrypted under. Sig is made with the file's
+// write key, or the append key with Base, the last chunk a writer stored,
+// signed with the write key in BaseSig. Size is the length of the whole
+// content, kept up by every write so it is known without loading the file.
+// Rekey is set by a sharee's revocation, as a hint for the owner to rotate
+// the file's keys.
+type ChunkPointer struct {
+	Chunk    uuid.UUID
+	Hash     []byte
+	Size     []byte
+	Sig      []byte
+	Base     uuid.UUID
+	BaseHash []byte
+	BaseSig  []byte
+	Rekey    bool
 }
 
 type ShareMap map[string][]byte
@@ -183,8 +272,12 @@ func AuthDec(sourceKey []byte, stored []byte) (unencrypted []byte, err error) {
 		return nil, err
 	}
 
-	hmac1 := stored[:64]
-	bytes_enc := stored[64:]
+	if len(stored) < userlib.HashSizeBytes+userlib.AESBlockSizeBytes {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	hmac1 := stored[:userlib.HashSizeBytes]
+	bytes_enc := stored[userlib.HashSizeBytes:]
 	hmac2, err := userlib.HMACEval(macKey, bytes_enc)
 	if err != nil {
 		return nil, err
@@ -199,19 +292,34 @@ func AuthDec(sourceKey []byte, stored []byte) (unencrypted []byte, err error) {
 
 }
 
-func StoreAuthEnc(data any, key []byte, dataUuid uuid.UUID) (err error) {
+func MarshalAuthEnc(data any, key []byte) (storable_data []byte, err error) {
 
 	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return AuthEnc(key, dataBytes)
+}
+
+func UnmarshalAuthDec(key []byte, stored_data []byte, data any) (err error) {
+
+	dataBytes, err := AuthDec(key, stored_data)
 	if err != nil {
 		return err
 	}
 
-	storable_data, err := AuthEnc(key, dataBytes)
+	return json.Unmarshal(dataBytes, data)
+}
+
+func StoreAuthEnc(data any, key []byte, dataUuid uuid.UUID) (err error) {
+
+	storable_data, err := MarshalAuthEnc(data, key)
 	if err != nil {
 		return err
 	}
 
-	userlib.DatastoreSet(dataUuid, storable_data)
+	store.Set(dataUuid, storable_data)
 	return
 }
 
@@ -222,15 +330,23 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	var publicKey userlib.PKEEncKey
 	var verifyKey userlib.DSVerifyKey
 
+	if isGroup(username) || isLink(username) {
+		return nil, errors.New("usernames cannot start with " + groupPrefix + " or " + linkPrefix)
+	}
+
+	userdata.Username = username
 	userdata.Username_hash = userlib.Hash([]byte(username))
 
 	userdata.FilenameKey = userlib.RandomBytes(16)
 
 	publicKey, userdata.DecKey, _ = userlib.PKEKeyGen()
-	userlib.KeystoreSet(username+"_Public", publicKey)
+	KeystoreSet(username+"_Public", publicKey)
 
 	userdata.SignKey, verifyKey, _ = userlib.DSKeyGen()
-	userlib.KeystoreSet(username+"_Verify", verifyKey)
+	KeystoreSet(username+"_Verify", verifyKey)
+
+	userdata.KeyVersion = 1
+	userdata.Indexed = true
 
 	userKey := userlib.Argon2Key([]byte(password), userdata.Username_hash, 16)
 
@@ -239,7 +355,13 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 		return nil, err
 	}
 
-	StoreAuthEnc(userdata, userKey, userUuid)
+	userdata.storedUser, err = MarshalAuthEnc(&userdata, userKey)
+	if err != nil {
+		return nil, err
+	}
+	store.Set(userUuid, userdata.storedUser)
+	userdata.userKey = userKey
+	userdata.session = uuid.New()
 
 	return &userdata, nil
 }
@@ -256,7 +378,7 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 		return nil, err
 	}
 
-	stored_userdata, ok := userlib.DatastoreGet(userUuid)
+	stored_userdata, ok := store.Get(userUuid)
 	if !ok {
 		return nil, errors.New("No such user " + username)
 	}
@@ -270,83 +392,30 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 	if err != nil {
 		return nil, err
 	}
+	userdata.userKey = userKey
+	userdata.storedUser = stored_userdata
+	userdata.session = uuid.New()
 
-	userdataptr = &userdata
-	return userdataptr, nil
-}
-
-func (userdata *User) StoreFile(filename string, content []byte) (err error) {
-	var chunk FileChunk
-	var node UserFileNode
-	var NodeKey []byte
-
-	NodeKeyUuid, err := DeriveUuid(userdata.FilenameKey, filename)
+	// finish whatever a crashed session of this user left half done
+	_, err = userdata.recoverJournal()
 	if err != nil {
-		return err
-	}
-	// check if file already exstis
-	_, ok := userlib.DatastoreGet(NodeKeyUuid)
-	if ok {
-		// overwrite
-		NodeKey, err = GetNodeKey(filename, userdata.FilenameKey)
-		if err != nil {
-			return err
-		}
-
-		node, err = GetNode(NodeKey)
-		if err != nil {
-			return err
-		}
-
-	} else {
-		NodeKey := userlib.RandomBytes(16)
-		storable_NodeKey, err := AuthEnc(userdata.FilenameKey, NodeKey)
-		if err != nil {
-			return err
-		}
-		userlib.DatastoreSet(NodeKeyUuid, storable_NodeKey)
-
-		node.LastChunkUuid = uuid.New()
-		node.FileKey = userlib.RandomBytes(16)
-
-		sharedTo := make(ShareMap)
-
-		sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
-		if err != nil {
-			return err
-		}
-
-		err = StoreAuthEnc(sharedTo, NodeKey, sharedToUuid)
-		if err != nil {
-			return err
-		}
-
-		nodeUuid, err := DeriveUuid(NodeKey, "UserFileNode")
-		if err != nil {
-			return err
-		}
-
-		err = StoreAuthEnc(node, NodeKey, nodeUuid)
-		if err != nil {
-			return err
-		}
+		return nil, err
 	}
-
-	chunkUuid := uuid.New()
-	chunk.Content = content
-	chunk.Prev = uuid.Nil
-
-	err = StoreAuthEnc(chunk, node.FileKey, chunkUuid)
+	err = userdata.finishFilenameKeyRotation()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	err = StoreAuthEnc(chunkUuid, node.FileKey, node.LastChunkUuid)
+	err = userdata.finishKeyRotation()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	userdataptr = &userdata
+	return userdataptr, nil
+}
+
+func (userdata *User) StoreFile(filename string, content []byte) (err error) {
+	return userdata.StoreFiles(map[string][]byte{filename: content})[filename]
 }
 
 func GetNodeKey(filename string, filenameKey []byte) (NodeKey []byte, err error) {
@@ -356,7 +425,7 @@ func GetNodeKey(filename string, filenameKey []byte) (NodeKey []byte, err error)
 		return nil, err
 	}
 
-	stored_NodeKey, ok := userlib.DatastoreGet(NodeKeyUuid)
+	stored_NodeKey, ok := store.Get(NodeKeyUuid)
 	if !ok {
 		return nil, errors.New(filename + "not in users'namespace")
 	}
@@ -378,7 +447,7 @@ func GetNode(NodeKey []byte) (node UserFileNode, err error) {
 		return node, err
 	}
 
-	stored_node, ok := userlib.DatastoreGet(nodeUuid)
+	stored_node, ok := store.Get(nodeUuid)
 	if !ok {
 		return node, errors.New("Node missing")
 	}
@@ -396,25 +465,47 @@ func GetNode(NodeKey []byte) (node UserFileNode, err error) {
 	return node, nil
 }
 
-func GetLastChunk(node UserFileNode) (lastChunk uuid.UUID, err error) {
+func GetLastChunk(node UserFileNode) (lastChunk ChunkPointer, stored_lastChunk []byte, err error) {
 
-	stored_lastChunk, ok := userlib.DatastoreGet(node.LastChunkUuid)
+	stored_lastChunk, ok := store.Get(node.LastChunkUuid)
 	if !ok {
-		return uuid.Nil, errors.New("lastChunkuuid is gone")
+		return lastChunk, nil, errors.New("lastChunkuuid is gone")
 	}
 
 	LastChunkBytes, err := AuthDec(node.FileKey, stored_lastChunk)
 	if err != nil {
-		return uuid.Nil, err
+		return lastChunk, nil, err
 	}
 
 	err = json.Unmarshal(LastChunkBytes, &lastChunk)
 	if err != nil {
-		return uuid.Nil, err
+		return lastChunk, nil, err
+	}
+
+	err = node.verifyPointer(lastChunk)
+	if err != nil {
+		return lastChunk, nil, err
 	}
 
-	return lastChunk, nil
+	return lastChunk, stored_lastChunk, nil
+
+}
+
+// EncryptChunk encrypts chunk for storage at chunkUuid and returns the
+// pointer that refers to it.
+func EncryptChunk(chunk FileChunk, chunkUuid uuid.UUID, fileKey []byte) (storable_chunk []byte, pointer ChunkPointer, err error) {
+
+	chunkBytes, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, pointer, err
+	}
+
+	storable_chunk, err = AuthEnc(fileKey, chunkBytes)
+	if err != nil {
+		return nil, pointer, err
+	}
 
+	return storable_chunk, ChunkPointer{Chunk: chunkUuid, Hash: userlib.Hash(chunkBytes)}, nil
 }
 
 func GetSharedTo(NodeKey []byte) (sharedTo ShareMap, err error) {
@@ -424,7 +515,7 @@ func GetSharedTo(NodeKey []byte) (sharedTo ShareMap, err error) {
 		return nil, err
 	}
 
-	stored_sharedTo, ok := userlib.DatastoreGet(sharedToUuid)
+	stored_sharedTo, ok := store.Get(sharedToUuid)
 	if !ok {
 		return nil, errors.New("Sharemap missing")
 	}
@@ -442,150 +533,226 @@ func GetSharedTo(NodeKey []byte) (sharedTo ShareMap, err error) {
 }
 
 func (userdata *User) AppendToFile(filename string, content []byte) error {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
 	var chunk FileChunk
 
-	NodeKey, err := GetNodeKey(filename, userdata.FilenameKey)
+	file, err := userdata.openFile(filename)
 	if err != nil {
 		return err
 	}
 
-	node, err := GetNode(NodeKey)
+	due, err := userdata.rekeyDue(file)
 	if err != nil {
 		return err
 	}
+	if due {
+		err = userdata.rekey(filename, file)
+		if err != nil {
+			return err
+		}
+
+		file, err = userdata.openFile(filename)
+		if err != nil {
+			return err
+		}
+	}
+	node, lastChunk, stored_lastChunk := file.Node, file.LastChunk, file.StoredLastChunk
 
-	lastChunk, err := GetLastChunk(node)
+	err = node.require(PermAppend)
 	if err != nil {
 		return err
 	}
 
-	chunkUuid := uuid.New()
 	chunk.Content = content
-	chunk.Prev = lastChunk
 
-	err = StoreAuthEnc(chunk, node.FileKey, chunkUuid)
-	if err != nil {
-		return err
-	}
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			lastChunk, stored_lastChunk, err = GetLastChunk(node)
+			if err != nil {
+				return err
+			}
+		}
 
-	err = StoreAuthEnc(chunkUuid, node.FileKey, node.LastChunkUuid)
-	if err != nil {
-		return err
-	}
+		chunkUuid := uuid.New()
+		chunk.Prev = lastChunk.Chunk
+		chunk.PrevHash = lastChunk.Hash
 
-	return nil
+		storable_chunk, pointer, err := EncryptChunk(chunk, chunkUuid, node.FileKey)
+		if err != nil {
+			return err
+		}
+		pointer.Size = sizeBytes(lastChunk.size() + len(content))
+		pointer.Rekey = lastChunk.Rekey
+		pointer.Base, pointer.BaseHash, pointer.BaseSig = lastChunk.Base, lastChunk.BaseHash, lastChunk.BaseSig
 
-}
+		err = node.signPointer(&pointer)
+		if err != nil {
+			return err
+		}
 
-func (userdata *User) LoadFile(filename string) (content []byte, err error) {
-	var chunk FileChunk
+		storable_lastChunk, err := MarshalAuthEnc(pointer, node.FileKey)
+		if err != nil {
+			return err
+		}
 
-	NodeKey, err := GetNodeKey(filename, userdata.FilenameKey)
-	if err != nil {
-		return nil, err
-	}
+		lost, err := userdata.commit(journalEntry{
+			Sets:  map[uuid.UUID][]byte{chunkUuid: storable_chunk},
+			Swaps: []journalSwap{{Key: node.LastChunkUuid, Old: stored_lastChunk, New: storable_lastChunk, Undo: []uuid.UUID{chunkUuid}}},
+		})
+		if err != nil {
+			return err
+		}
 
-	node, err := GetNode(NodeKey)
-	if err != nil {
-		return nil, err
-	}
+		if len(lost) == 0 {
+			chunk.Content = append([]byte{}, content...)
+			userdata.getCache().setChunk(chunkUuid, chunk)
+			return nil
+		}
 
-	lastChunk, err := GetLastChunk(node)
-	if err != nil {
-		return nil, err
+		// someone appended in between, chain onto their chunk instead
 	}
 
-	stored_chunk, ok := userlib.DatastoreGet(lastChunk)
-	if !ok {
-		return nil, errors.New("no chunk")
-	}
+	return ErrConflict
 
-	chunkBytes, err := AuthDec(node.FileKey, stored_chunk)
-	if err != nil {
-		return nil, err
-	}
+}
 
-	err = json.Unmarshal(chunkBytes, &chunk)
-	if err != nil {
-		return nil, err
+func (userdata *User) LoadFile(filename string) (content []byte, err error) {
+	contents, errs := userdata.LoadFiles([]string{filename})
+	if errs[filename] != nil {
+		return nil, errs[filename]
 	}
+	return contents[filename], nil
+}
 
-	content = chunk.Content
-
-	for chunk.Prev != uuid.Nil {
-		stored_chunk, ok = userlib.DatastoreGet(chunk.Prev)
-		if !ok {
-			return content, errors.New("missing chunk")
-		}
+// CreateInvitation shares filename with recipientUsername. By default the
+// recipient gets the same permissions as the sender and one level less of
+// resharing; WithPermissions and WithReshareDepth narrow them. Only users
+// whose own grant allows resharing can create invitations.
+func (userdata *User) CreateInvitation(filename string, recipientUsername string, options ...InviteOption) (invitationPtr uuid.UUID, err error) {
+	var rNode UserFileNode
+	var opts inviteOptions
+	for _, option := range options {
+		option(&opts)
+	}
 
-		chunkBytes, err = AuthDec(node.FileKey, stored_chunk)
+	var group Group
+	var rPublicKey userlib.PKEEncKey
+	if isGroup(recipientUsername) {
+		group, err = groupOf(recipientUsername)
 		if err != nil {
-			return content, err
+			return invitationPtr, err
 		}
+		rPublicKey = group.PublicKey
 
-		err = json.Unmarshal(chunkBytes, &chunk)
-		if err != nil {
-			return content, err
+		// members reach the file through the group and cannot reshare it
+		WithReshareDepth(0)(&opts)
+	} else {
+		var ok bool
+		rPublicKey, ok = publicKeyOf(recipientUsername)
+		if !ok {
+			return invitationPtr, errors.New("recpient Doesn't exist")
 		}
-		content = append(chunk.Content, content...)
 	}
-	return content, nil
 
-}
-
-func (userdata *User) CreateInvitation(filename string, recipientUsername string) (invitationPtr uuid.UUID, err error) {
-	var rNode UserFileNode
-
-	rPublicKey, ok := userlib.KeystoreGet(recipientUsername + "_Public")
-	if !ok {
-		return invitationPtr, errors.New("recpient Doesn't exist")
-	}
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
 
 	// Retrieve sender File Node
 
-	sNodeKey, err := GetNodeKey(filename, userdata.FilenameKey)
+	file, err := userdata.openFile(filename)
 	if err != nil {
 		return invitationPtr, err
 	}
+	sNodeKey, sNode := file.NodeKey, file.Node
 
 	rNodeKey := userlib.RandomBytes(16)
 
 	invitationPtr = uuid.New()
 
-	// Use RSA to encrypt invitation and Store at invitationPtr
-
-	rNodeKey_enc, err := userlib.PKEEnc(rPublicKey, rNodeKey)
+	sGrant, sChain, record, err := grantOf(sNodeKey, userdata.Username)
 	if err != nil {
 		return invitationPtr, err
 	}
-	rNodeKey_sig, err := userlib.DSSign(userdata.SignKey, rNodeKey_enc)
+
+	// a group's invitation stays for every member to accept
+	grantPtr := invitationPtr
+	if isGroup(recipientUsername) {
+		grantPtr = uuid.Nil
+	}
+
+	rGrant, err := userdata.newGrant(sGrant, record.FileID, recipientUsername, grantPtr, opts)
 	if err != nil {
 		return invitationPtr, err
 	}
+	rChain := append(append(GrantChain{}, sChain...), rGrant)
 
-	userlib.DatastoreSet(invitationPtr, append(rNodeKey_sig, rNodeKey_enc...))
+	rNode.FileKey = sNode.FileKey
+	rNode.LastChunkUuid = sNode.LastChunkUuid
+	rNode.Perms = rGrant.Perms
+	rNode.VerifyKey = sNode.VerifyKey
+	rNode.AppendVerifyKey = sNode.AppendVerifyKey
+	if rNode.Perms&PermWrite != 0 {
+		rNode.WriteKey = sNode.WriteKey
+	}
+	if rNode.Perms&PermAppend != 0 {
+		rNode.AppendKey = sNode.AppendKey
+	}
+
+	envelope := invitationEnvelope{
+		NodeKey: rNodeKey,
+		Details: InvitationDetails{Filename: filename, Size: file.LastChunk.size(), Perms: rGrant.Perms, Message: opts.message},
+	}
 
-	sNode, err := GetNode(sNodeKey)
+	var invitation []byte
+	if isGroup(recipientUsername) {
+		invitation, err = userdata.sealGroupSlot(group, invitationPtr, envelope)
+	} else {
+		invitation, err = userdata.sealInvitation(recipientUsername, rPublicKey, invitationPtr, envelope)
+	}
 	if err != nil {
 		return invitationPtr, err
 	}
 
-	rNode.FileKey = sNode.FileKey
-	rNode.LastChunkUuid = sNode.LastChunkUuid
+	// The invitation, rNode, the recipient's copy of the owner record and
+	// grant chain, rSharedTo and the sender's updated ShareMap are written together as
+	// one journal entry
 
-	// Store rNode
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+	entry.Sets[invitationPtr] = invitation
 
 	rNodeUuid, err := DeriveUuid(rNodeKey, "UserFileNode")
 	if err != nil {
 		return invitationPtr, err
 	}
 
-	err = StoreAuthEnc(rNode, rNodeKey, rNodeUuid)
+	entry.Sets[rNodeUuid], err = MarshalAuthEnc(rNode, rNodeKey)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	rRecordUuid, err := DeriveUuid(rNodeKey, "OwnerRecord")
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	entry.Sets[rRecordUuid], err = MarshalAuthEnc(record, rNodeKey)
 	if err != nil {
 		return invitationPtr, err
 	}
 
-	// Store rSharedTo
+	rChainUuid, err := DeriveUuid(rNodeKey, "Grants")
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	entry.Sets[rChainUuid], err = MarshalAuthEnc(rChain, rNodeKey)
+	if err != nil {
+		return invitationPtr, err
+	}
 
 	rSharedTo := make(ShareMap)
 
@@ -594,14 +761,17 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 		return invitationPtr, err
 	}
 
-	err = StoreAuthEnc(rSharedTo, rNodeKey, rSharedToUuid)
+	entry.Sets[rSharedToUuid], err = MarshalAuthEnc(rSharedTo, rNodeKey)
 	if err != nil {
 		return invitationPtr, err
 	}
 
-	// Update sender shareMap and Restore
+	// Update sender shareMap
 
 	sSharedTo, err := GetSharedTo(sNodeKey)
+	if err != nil {
+		return invitationPtr, err
+	}
 
 	sSharedTo[recipientUsername] = rNodeKey
 
@@ -610,52 +780,92 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 		return invitationPtr, err
 	}
 
-	err = StoreAuthEnc(sSharedTo, sNodeKey, sSharedToUuid)
+	entry.Sets[sSharedToUuid], err = MarshalAuthEnc(sSharedTo, sNodeKey)
 	if err != nil {
 		return invitationPtr, err
 	}
 
+	// scheduled first, so a crash can only leave a file in the schedule
+	// with nothing to expire
+	if !rGrant.Until.IsZero() {
+		err = userdata.schedule(filename)
+		if err != nil {
+			return invitationPtr, err
+		}
+	}
+
+	if isGroup(recipientUsername) {
+		return invitationPtr, userdata.commitGroupInvitation(group, invitationPtr, entry)
+	}
+
+	// the note in the recipient's inbox goes in with everything else,
+	// unless another sender's note got there first
+	rInboxUuid, noteSwap, sentSwap, err := userdata.newNote(recipientUsername, rPublicKey, invitationPtr)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	swap, err := appendNote(rInboxUuid, noteSwap.Key)
+	if err != nil {
+		return invitationPtr, err
+	}
+	first := len(entry.Swaps)
+	entry.Swaps = append(entry.Swaps, sentSwap, noteSwap, swap)
+
+	lost, err := userdata.commit(entry)
+	if err != nil {
+		return invitationPtr, err
+	}
+	// the invitation stands without its note, the pointer can still be
+	// passed on out of band
+	for _, i := range lost {
+		if i == first+1 {
+			userdata.resendNote(recipientUsername, rPublicKey, invitationPtr)
+			break
+		}
+		if i == first+2 {
+			deliver(rInboxUuid, noteSwap.Key)
+		}
+	}
+
 	return invitationPtr, nil
 
 }
 
 func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) (err error) {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
 
-	NodeKeyUuid, err := DeriveUuid(userdata.FilenameKey, filename)
+	err = userdata.checkFree(filename)
 	if err != nil {
 		return err
 	}
-	_, ok := userlib.DatastoreGet(NodeKeyUuid)
-	if ok {
-		return errors.New(filename + "already in namespace")
-	}
-
-	sVerifyKey, ok := userlib.KeystoreGet(senderUsername + "_Verify")
-	if !ok {
-		return errors.New("sender doesnt exist")
-	}
 
-	data, ok := userlib.DatastoreGet(invitationPtr)
-	if !ok {
-		return errors.New("no invitationPTr")
+	NodeKey, err := userdata.openNodeKey(senderUsername, invitationPtr)
+	if err != nil {
+		return err
 	}
 
-	NodeKey_sig := data[:256]
-	NodeKey_enc := data[256:]
-
-	err = userlib.DSVerify(sVerifyKey, NodeKey_enc, NodeKey_sig)
+	node, err := GetNode(NodeKey)
 	if err != nil {
-		return errors.New("DSVerify fail")
+		return err
 	}
 
-	NodeKey, err := userlib.PKEDec(userdata.DecKey, NodeKey_enc)
+	// a sharee who was not allowed to reshare cannot make an invitation
+	// that passes this, whatever their client does
+	grant, _, _, err := grantOf(NodeKey, userdata.Username)
 	if err != nil {
-		return errors.New("PKEDec Failure")
+		return err
+	}
+	if grant.Grantor != senderUsername || grant.Invitation != invitationPtr || grant.Perms != node.Perms {
+		return errors.New("invitation does not match its grant")
+	}
+	if grant.inviteExpired() || grant.accessExpired() {
+		return ErrInvitationExpired
 	}
 
-	userlib.DatastoreDelete(invitationPtr) // clean pointer
-
-	node, err := GetNode(NodeKey)
+	NodeKeyUuid, err := userdata.freeSlot(filename)
 	if err != nil {
 		return err
 	}
@@ -665,7 +875,7 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 		return err
 	}
 
-	err = StoreAuthEnc(node, NodeKey, nodeUuid)
+	storable_node, err := MarshalAuthEnc(node, NodeKey)
 	if err != nil {
 		return err
 	}
@@ -675,151 +885,394 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 		return err
 	}
 
-	userlib.DatastoreSet(NodeKeyUuid, storable_NodeKey)
+	entry := journalEntry{
+		Sets:    map[uuid.UUID][]byte{nodeUuid: storable_node, NodeKeyUuid: storable_NodeKey},
+		Deletes: []uuid.UUID{invitationPtr},
+	}
+
+	err = userdata.markAccepted(NodeKey, entry.Sets)
+	if err != nil {
+		return err
+	}
+
+	// the invitation is only cleaned up once the NodeKey is stored
+	_, err = userdata.commitIndexed(entry, map[string]uuid.UUID{filename: NodeKeyUuid})
+	if err != nil {
+		return err
+	}
+	userdata.getCache().forget(filename)
 
 	return nil
 
 }
 
-func ChangeAcess(sharedTo ShareMap, revoked string, newChunkUuid uuid.UUID, newFileKey []byte) (err error) {
-	for username, NodeKey := range sharedTo {
+// ChangeAcess adds the updated UserFileNodes of everyone below sharedTo to
+// sets. ShareMaps are read as sets is about to store them, so users cut
+// off in the same journal entry are left out.
+func ChangeAcess(sharedTo ShareMap, newChunkUuid uuid.UUID, newFileKey []byte, sets map[uuid.UUID][]byte) (err error) {
+	for _, NodeKey := range sharedTo {
 		nodeUuid, err := DeriveUuid(NodeKey, "UserFileNode")
 		if err != nil {
 			return err
 		}
-		if username != revoked {
-			node, err := GetNode(NodeKey)
-			if err != nil {
-				return err
-			}
 
-			node.LastChunkUuid = newChunkUuid
-			node.FileKey = newFileKey
+		node, err := GetNode(NodeKey)
+		if err != nil {
+			return err
+		}
 
-			err = StoreAuthEnc(node, NodeKey, nodeUuid)
-			if err != nil {
-				return err
-			}
+		node.LastChunkUuid = newChunkUuid
+		node.FileKey = newFileKey
 
-			uSharedTo, err := GetSharedTo(NodeKey)
-			if err != nil {
-				return err
-			}
+		sets[nodeUuid], err = MarshalAuthEnc(node, NodeKey)
+		if err != nil {
+			return err
+		}
 
-			err = ChangeAcess(uSharedTo, revoked, newChunkUuid, newFileKey)
-			if err != nil {
-				return err
-			}
+		uSharedTo, err := pendingSharedTo(NodeKey, sets)
+		if err != nil {
+			return err
+		}
 
+		err = ChangeAcess(uSharedTo, newChunkUuid, newFileKey, sets)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 
 }
 
-func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
+// pendingSharedTo is GetSharedTo, but returns the ShareMap under NodeKey
+// as sets is about to store it, if it is there.
+func pendingSharedTo(NodeKey []byte, sets map[uuid.UUID][]byte) (sharedTo ShareMap, err error) {
+	sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
+	if err != nil {
+		return nil, err
+	}
+
+	stored_sharedTo, ok := sets[sharedToUuid]
+	if !ok {
+		return GetSharedTo(NodeKey)
+	}
+
+	err = UnmarshalAuthDec(NodeKey, stored_sharedTo, &sharedTo)
+	if err != nil {
+		return nil, err
+	}
+	return sharedTo, nil
+}
+
+// cutSharee removes every occurrence of revoked from the ShareMaps below
+// sharedTo (stored under NodeKey), and schedules the UserFileNodes and
+// ShareMaps of the subtrees cut off for deletion.
+func cutSharee(NodeKey []byte, sharedTo ShareMap, revoked string, entry *journalEntry) (found bool, err error) {
+	cut := false
+	for username, uNodeKey := range sharedTo {
+		if username == revoked {
+			err = dropSubtree(uNodeKey, entry)
+			if err != nil {
+				return false, err
+			}
+			delete(sharedTo, username)
+			cut = true
+			continue
+		}
+
+		uSharedTo, err := GetSharedTo(uNodeKey)
+		if err != nil {
+			return false, err
+		}
 
-	NodeKey, err := GetNodeKey(filename, userdata.FilenameKey)
+		uFound, err := cutSharee(uNodeKey, uSharedTo, revoked, entry)
+		if err != nil {
+			return false, err
+		}
+		found = found || uFound
+	}
+
+	if cut {
+		sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
+		if err != nil {
+			return false, err
+		}
+
+		entry.Sets[sharedToUuid], err = MarshalAuthEnc(sharedTo, NodeKey)
+		if err != nil {
+			return false, err
+		}
+	}
+	return found || cut, nil
+}
+
+// dropSubtree schedules the UserFileNode, owner record, grant chain,
+// ShareMap, revocation counts and accept marker under NodeKey, and those of
+// everyone below it, for deletion. The subtree belongs to revoked users,
+// who may have tampered with their ShareMaps to stall the revocation, so a
+// ShareMap that can't be read just ends the walk there.
+func dropSubtree(NodeKey []byte, entry *journalEntry) (err error) {
+	nodeUuid, err := DeriveUuid(NodeKey, "UserFileNode")
 	if err != nil {
 		return err
 	}
 
-	node, err := GetNode(NodeKey)
+	recordUuid, err := DeriveUuid(NodeKey, "OwnerRecord")
 	if err != nil {
 		return err
 	}
 
-	nodeUuid, err := DeriveUuid(NodeKey, "UserFileNode")
+	sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
 	if err != nil {
 		return err
 	}
 
-	sharedTo, err := GetSharedTo(NodeKey)
+	chainUuid, err := DeriveUuid(NodeKey, "Grants")
 	if err != nil {
 		return err
 	}
 
-	_, ok := sharedTo[recipientUsername]
+	countUuid, err := revocationsUuid(NodeKey)
+	if err != nil {
+		return err
+	}
 
-	if !ok {
-		return errors.New(filename + "hasn't been shared with" + recipientUsername)
+	seenUuid, err := seenUuid(NodeKey)
+	if err != nil {
+		return err
 	}
 
-	lastChunk, err := GetLastChunk(node)
+	markerUuid, err := DeriveUuid(NodeKey, "Accepted")
 	if err != nil {
 		return err
 	}
 
-	var chunk FileChunk
+	entry.Deletes = append(entry.Deletes, nodeUuid, recordUuid, chainUuid, sharedToUuid, countUuid, seenUuid, markerUuid)
 
-	stored_chunk, ok := userlib.DatastoreGet(lastChunk)
-	if !ok {
-		return errors.New("no chunk")
+	sharedTo, err := GetSharedTo(NodeKey)
+	if err != nil {
+		return nil
+	}
+
+	for _, uNodeKey := range sharedTo {
+		err = dropSubtree(uNodeKey, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotate adds to entry a new key epoch for file: a new FileKey for
+// everything written from now on and a new pointer location, handed to the
+// owner and everyone below sharedTo who is not cut off in entry. It
+// returns the owner's updated node.
+func rotate(file openedFile, sharedTo ShareMap, entry *journalEntry) (node UserFileNode, err error) {
+	node = file.Node
+
+	ring, err := GetKeyRing(node.FileKey)
+	if err != nil {
+		return node, err
+	}
+
+	oldRingUuid, err := DeriveUuid(node.FileKey, "KeyRing")
+	if err != nil {
+		return node, err
+	}
+
+	nodeUuid, err := DeriveUuid(file.NodeKey, "UserFileNode")
+	if err != nil {
+		return node, err
+	}
+
+	// The chunks stay where they are and are re-encrypted as they are read,
+	// with the old keys kept on the ring until then.
+
+	entry.Deletes = append(entry.Deletes, node.LastChunkUuid, oldRingUuid)
+
+	ring = append(KeyRing{node.FileKey}, ring...)
+
+	node.FileKey = userlib.RandomBytes(16)
+	node.LastChunkUuid = uuid.New()
+
+	ringUuid, err := DeriveUuid(node.FileKey, "KeyRing")
+	if err != nil {
+		return node, err
+	}
+
+	entry.Sets[ringUuid], err = MarshalAuthEnc(ring, node.FileKey)
+	if err != nil {
+		return node, err
+	}
+
+	pointer := file.LastChunk
+	pointer.Rekey = false
+
+	entry.Sets[node.LastChunkUuid], err = MarshalAuthEnc(pointer, node.FileKey)
+	if err != nil {
+		return node, err
+	}
+
+	entry.Sets[nodeUuid], err = MarshalAuthEnc(node, file.NodeKey)
+	if err != nil {
+		return node, err
+	}
+
+	err = ChangeAcess(sharedTo, node.LastChunkUuid, node.FileKey, entry.Sets)
+	if err != nil {
+		return node, err
+	}
+
+	// a revocation counted after this walk brings about another rotation
+	seen := make(map[string]int)
+	countRevocations(file.NodeKey, entry.Sets, seen)
+
+	seenUuid, err := seenUuid(file.NodeKey)
+	if err != nil {
+		return node, err
+	}
+
+	entry.Sets[seenUuid], err = MarshalAuthEnc(seen, file.NodeKey)
+	if err != nil {
+		return node, err
 	}
 
-	userlib.DatastoreDelete(lastChunk)
-	userlib.DatastoreDelete(node.LastChunkUuid) //delete lastChunk
+	return node, nil
+}
+
+// rekey finishes the revocations sharees have made since the owner last
+// touched filename, by rotating its keys. The caller holds the file lock.
+func (userdata *User) rekey(filename string, file openedFile) (err error) {
+	sharedTo, err := GetSharedTo(file.NodeKey)
+	if err != nil {
+		return err
+	}
 
-	chunkBytes, err := AuthDec(node.FileKey, stored_chunk)
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+	node, err := rotate(file, sharedTo, &entry)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(chunkBytes, &chunk)
+	_, err = userdata.commit(entry)
 	if err != nil {
 		return err
 	}
+	userdata.getCache().setFile(filename, file.NodeKey, node)
+	return nil
+}
 
-	content := chunk.Content
+var ErrRevokeSelf = errors.New("cannot revoke your own access")
+var ErrNoSuchUser = errors.New("no such user")
+var ErrNotInSubtree = errors.New("user is not among those the file was shared with by you or by anyone you shared it with")
 
-	for chunk.Prev != uuid.Nil {
+// RevokeAccess revokes recipientUsername's access, and that of everyone
+// they shared the file with, wherever they are below the caller in the
+// share tree. The owner's subtree is the whole tree. An owner's revocation
+// rotates the file's keys at once. A sharee can't reach the rest of the
+// tree, so it cuts the revoked users' UserFileNodes off, and the owner's
+// client rotates the keys on its next write or flagged access.
+func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
+	if bytes.Equal(userlib.Hash([]byte(recipientUsername)), userdata.Username_hash) {
+		return ErrRevokeSelf
+	}
 
-		stored_chunk, ok = userlib.DatastoreGet(chunk.Prev)
+	if !isGroup(recipientUsername) && !isLink(recipientUsername) {
+		_, ok := publicKeyOf(recipientUsername)
 		if !ok {
-			return errors.New("missing chunk")
+			return ErrNoSuchUser
 		}
+	}
+
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := userdata.openFile(filename)
+	if err != nil {
+		return err
+	}
+
+	sharedTo, err := GetSharedTo(file.NodeKey)
+	if err != nil {
+		return err
+	}
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+
+	found, err := cutSharee(file.NodeKey, sharedTo, recipientUsername, &entry)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotInSubtree
+	}
+
+	return userdata.finishRevocation(filename, file, sharedTo, entry)
+}
 
-		userlib.DatastoreDelete(chunk.Prev) // Delete each chunk
+// finishRevocation commits entry, which cuts users off below sharedTo in
+// file. The owner rotates the keys in the same entry. A sharee can't reach
+// the rest of the tree, so it counts the revocation where only the owner
+// looks and flags the pointer, for the owner's client to rotate the keys.
+// The caller holds the file lock.
+func (userdata *User) finishRevocation(filename string, file openedFile, sharedTo ShareMap, entry journalEntry) (err error) {
+	owner, err := userdata.isOwner(file.NodeKey)
+	if err != nil {
+		return err
+	}
 
-		chunkBytes, err = AuthDec(node.FileKey, stored_chunk)
+	if owner {
+		node, err := rotate(file, sharedTo, &entry)
 		if err != nil {
 			return err
 		}
 
-		err = json.Unmarshal(chunkBytes, &chunk)
+		_, err = userdata.commit(entry)
 		if err != nil {
 			return err
 		}
-		content = append(chunk.Content, content...)
+		userdata.getCache().setFile(filename, file.NodeKey, node)
+		return nil
 	}
 
-	node.FileKey = userlib.RandomBytes(16)
-	node.LastChunkUuid = uuid.New()
-
-	chunkUuid := uuid.New()
-	chunk.Content = content
-	chunk.Prev = uuid.Nil
-
-	err = StoreAuthEnc(chunk, node.FileKey, chunkUuid)
+	// count the revocation for the owner, where the revoked users can't
+	// undo it
+	countUuid, err := revocationsUuid(file.NodeKey)
 	if err != nil {
 		return err
 	}
 
-	err = StoreAuthEnc(chunkUuid, node.FileKey, node.LastChunkUuid)
+	entry.Sets[countUuid], err = MarshalAuthEnc(getRevocations(file.NodeKey)+1, file.NodeKey)
 	if err != nil {
 		return err
 	}
 
-	err = StoreAuthEnc(node, NodeKey, nodeUuid)
+	_, err = userdata.commit(entry)
 	if err != nil {
 		return err
 	}
 
-	err = ChangeAcess(sharedTo, recipientUsername, node.LastChunkUuid, node.FileKey)
-	if err != nil {
-		return err
-	}
+	// ask the owner to rotate the keys
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			file.LastChunk, file.StoredLastChunk, err = GetLastChunk(file.Node)
+			if err != nil {
+				return err
+			}
+		}
 
-	return nil
+		pointer := file.LastChunk
+		pointer.Rekey = true
+
+		storable_lastChunk, err := MarshalAuthEnc(pointer, file.Node.FileKey)
+		if err != nil {
+			return err
+		}
+
+		if store.CompareAndSwap(file.Node.LastChunkUuid, file.StoredLastChunk, storable_lastChunk) {
+			return nil
+		}
+	}
+	return ErrConflict
 
 }
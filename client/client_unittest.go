@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
 
 	_ "encoding/hex"
 
@@ -60,5 +61,46 @@ var _ = Describe("Client Unit Tests", func() {
 			// struct fields because not all implementations will have a username field.
 			Expect(alice.Username_hash).To(Equal(userlib.Hash([]byte("alice"))))
 		})
+
+		Specify("An appender cannot replace what a writer stored", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("file", []byte("stored"))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation("file", "bob", WithPermissions(PermAppend))
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "file")
+			Expect(err).To(BeNil())
+
+			file, err := bob.openFile("file")
+			Expect(err).To(BeNil())
+			Expect(file.Node.WriteKey).To(BeNil())
+
+			userlib.DebugMsg("Bob signs a pointer to a chain of his own with the append key.")
+			chunkUuid := uuid.New()
+			storable_chunk, pointer, err := EncryptChunk(FileChunk{Content: []byte("replaced")}, chunkUuid, file.Node.FileKey)
+			Expect(err).To(BeNil())
+			pointer.Base, pointer.BaseHash, pointer.BaseSig = file.LastChunk.Base, file.LastChunk.BaseHash, file.LastChunk.BaseSig
+			err = file.Node.signPointer(&pointer)
+			Expect(err).To(BeNil())
+			storable_lastChunk, err := MarshalAuthEnc(pointer, file.Node.FileKey)
+			Expect(err).To(BeNil())
+			store.Set(chunkUuid, storable_chunk)
+			Expect(store.CompareAndSwap(file.Node.LastChunkUuid, file.StoredLastChunk, storable_lastChunk)).To(BeTrue())
+
+			_, err = alice.LoadFile("file")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Without the Base the pointer is not taken either.")
+			pointer.Base, pointer.BaseHash, pointer.BaseSig = uuid.Nil, nil, nil
+			storable_forged, err := MarshalAuthEnc(pointer, file.Node.FileKey)
+			Expect(err).To(BeNil())
+			Expect(store.CompareAndSwap(file.Node.LastChunkUuid, storable_lastChunk, storable_forged)).To(BeTrue())
+
+			_, err = alice.LoadFile("file")
+			Expect(err).ToNot(BeNil())
+		})
 	})
 })
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+var now = time.Now
+
+// FakeClock is a clock for tests that stands still until it is moved on.
+type FakeClock struct {
+	mu sync.Mutex
+	at time.Time
+}
+
+// UseFakeClock makes the package read the current time from a FakeClock,
+// set to the real time, and returns it with a function that puts the real
+// clock back. It must not be called while operations are running.
+func UseFakeClock() (clock *FakeClock, restore func()) {
+	clock = &FakeClock{at: time.Now()}
+	previous := now
+	now = clock.Now
+	return clock, func() { now = previous }
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.at
+}
+
+// In returns the time the given number of minutes after the clock's.
+func (clock *FakeClock) In(minutes int) time.Time {
+	return clock.Now().Add(time.Duration(minutes) * time.Minute)
+}
+
+// Advance moves the clock on by the given number of minutes.
+func (clock *FakeClock) Advance(minutes int) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.at = clock.at.Add(time.Duration(minutes) * time.Minute)
+}
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// InvitationDetails is what an invitation tells its recipient about the
+// file before they accept it. Filename is only the sender's suggestion.
+type InvitationDetails struct {
+	Filename string
+	Size     int
+	Perms    Permission
+	Message  string
+}
+
+// invitationEnvelope is what gets sealed for the recipient at an
+// invitationPtr.
+type invitationEnvelope struct {
+	NodeKey []byte
+	Details InvitationDetails
+}
+
+// WithMessage attaches a message for the recipient to the invitation.
+func WithMessage(message string) InviteOption {
+	return func(options *inviteOptions) {
+		options.message = message
+	}
+}
+
+// A sealed invitation starts with a version byte, followed by its fields,
+// each preceded by its length as 4 bytes, big-endian. Version 2 has four:
+// a random nonce, the RSA-encrypted envelope key, the envelope encrypted
+// under it, and the sender's signature. No field has a fixed size, so
+// neither the envelope nor the keys are limited by the format.
+const invitationVersion = 2
+
+var ErrInvitationFormat = errors.New("malformed invitation")
+
+func appendField(data []byte, field []byte) []byte {
+	n := len(field)
+	data = append(data, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(data, field...)
+}
+
+// splitFields parses the fields following the version byte of a sealed
+// invitation, and returns each along with where it ends in data.
+func splitFields(data []byte) (fields [][]byte, ends []int, err error) {
+	offset := 1
+	for offset < len(data) {
+		if len(data)-offset < 4 {
+			return nil, nil, ErrInvitationFormat
+		}
+		n := int(data[offset])<<24 | int(data[offset+1])<<16 | int(data[offset+2])<<8 | int(data[offset+3])
+		offset += 4
+		if n < 0 || n > len(data)-offset {
+			return nil, nil, ErrInvitationFormat
+		}
+		fields = append(fields, data[offset:offset+n])
+		offset += n
+		ends = append(ends, offset)
+	}
+	return fields, ends, nil
+}
+
+// invitationSigned is what the sender of an invitation signs: who sent it
+// to whom, and where, followed by the invitation up to the signature. An
+// invitation moved to another invitationPtr, or claimed to be from or for
+// someone else, fails verification.
+func invitationSigned(sender string, recipient string, invitationPtr uuid.UUID, sealed []byte) []byte {
+	context := fmt.Sprintf("invitation %d:%s %d:%s %s ", len(sender), sender, len(recipient), recipient, invitationPtr)
+	return append([]byte(context), sealed...)
+}
+
+// hybridEnc encrypts data for the holder of rPublicKey. RSA only encrypts
+// a fresh key, under which data itself is encrypted, so data can be any
+// size.
+func hybridEnc(rPublicKey userlib.PKEEncKey, data any) (key_enc []byte, data_enc []byte, err error) {
+	key := userlib.RandomBytes(16)
+
+	key_enc, err = userlib.PKEEnc(rPublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data_enc, err = MarshalAuthEnc(data, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key_enc, data_enc, nil
+}
+
+// hybridDec decrypts what hybridEnc encrypted for the public key of one
+// of decKeys.
+func hybridDec(decKeys []userlib.PKEDecKey, key_enc []byte, data_enc []byte, data any) (err error) {
+	for _, decKey := range decKeys {
+		key, err := userlib.PKEDec(decKey, key_enc)
+		if err == nil {
+			return UnmarshalAuthDec(key, data_enc, data)
+		}
+	}
+	return errors.New("PKEDec Failure")
+}
+
+// sealInvitation encrypts envelope for recipient, to be stored at
+// invitationPtr, and signs it.
+func (userdata *User) sealInvitation(recipient string, rPublicKey userlib.PKEEncKey, invitationPtr uuid.UUID, envelope invitationEnvelope) (sealed []byte, err error) {
+	envelopeKey_enc, envelope_enc, err := hybridEnc(rPublicKey, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed = []byte{invitationVersion}
+	sealed = appendField(sealed, userlib.RandomBytes(16))
+	sealed = appendField(sealed, envelopeKey_enc)
+	sealed = appendField(sealed, envelope_enc)
+
+	sig, err := userdata.sign(invitationSigned(userdata.Username, recipient, invitationPtr, sealed))
+	if err != nil {
+		return nil, err
+	}
+	return appendField(sealed, sig), nil
+}
+
+// openInvitation verifies and decrypts the envelope senderUsername sealed
+// at invitationPtr.
+func (userdata *User) openInvitation(senderUsername string, invitationPtr uuid.UUID) (envelope invitationEnvelope, err error) {
+	_, ok := publicKeyOf(senderUsername)
+	if !ok {
+		return envelope, errors.New("sender doesnt exist")
+	}
+
+	data, ok := store.Get(invitationPtr)
+	if !ok {
+		return envelope, errors.New("no invitationPTr")
+	}
+	if isTombstone(data) {
+		return envelope, checkTombstone(senderUsername, invitationPtr, data)
+	}
+
+	if len(data) == 0 || data[0] != invitationVersion {
+		return envelope, ErrInvitationFormat
+	}
+	fields, ends, err := splitFields(data)
+	if err != nil {
+		return envelope, err
+	}
+	if len(fields) != 4 {
+		return envelope, ErrInvitationFormat
+	}
+	envelopeKey_enc, envelope_enc, sig := fields[1], fields[2], fields[3]
+
+	signed := invitationSigned(senderUsername, userdata.Username, invitationPtr, data[:ends[2]])
+	err = verifyBy(senderUsername, signed, sig)
+	if err != nil {
+		return envelope, errors.New("DSVerify fail")
+	}
+
+	err = hybridDec(userdata.decKeys(), envelopeKey_enc, envelope_enc, &envelope)
+	if err != nil {
+		return envelope, err
+	}
+	return envelope, nil
+}
+
+// openNodeKey verifies and decrypts the NodeKey senderUsername sealed at
+// invitationPtr.
+func (userdata *User) openNodeKey(senderUsername string, invitationPtr uuid.UUID) (NodeKey []byte, err error) {
+	envelope, err := userdata.openInvitation(senderUsername, invitationPtr)
+	if err != nil {
+		return nil, err
+	}
+	return envelope.NodeKey, nil
+}
+
+// InspectInvitation shows what the invitation senderUsername made at
+// invitationPtr is for, without accepting it. The permissions are those of
+// the grant the sender signed, which are what AcceptInvitation gives.
+func (userdata *User) InspectInvitation(senderUsername string, invitationPtr uuid.UUID) (details InvitationDetails, err error) {
+	details, _, err = userdata.inspectInvitation(senderUsername, invitationPtr)
+	return details, err
+}
+
+func (userdata *User) inspectInvitation(senderUsername string, invitationPtr uuid.UUID) (details InvitationDetails, grant Grant, err error) {
+	envelope, err := userdata.openInvitation(senderUsername, invitationPtr)
+	if err != nil {
+		return details, grant, err
+	}
+
+	grant, _, _, err = grantOf(envelope.NodeKey, userdata.Username)
+	if err != nil {
+		return details, grant, err
+	}
+	if grant.Grantor != senderUsername || grant.Invitation != invitationPtr {
+		return details, grant, errors.New("invitation does not match its grant")
+	}
+
+	details = envelope.Details
+	details.Perms = grant.Perms
+	return details, grant, nil
+}
+
+// A ChunkPointer's Size is 8 bytes, most significant first, so that the
+// pointer is the same size however long the file is.
+func sizeBytes(size int) []byte {
+	encoded := make([]byte, 8)
+	for i := 7; i >= 0; i-- {
+		encoded[i] = byte(size)
+		size >>= 8
+	}
+	return encoded
+}
+
+// size returns the length of the content pointer points to.
+func (pointer ChunkPointer) size() (size int) {
+	for _, b := range pointer.Size {
+		size = size<<8 | int(b)
+	}
+	return size
+}
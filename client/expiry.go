@@ -0,0 +1,223 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Every user keeps a schedule: the filenames in their namespace below which
+// they made grants that expire. It is encrypted with a key derived from the
+// FilenameKey, like the journal.
+func scheduleKeys(filenameKey []byte) (scheduleKey []byte, scheduleUuid uuid.UUID, err error) {
+	scheduleKey, err = userlib.HashKDF(filenameKey, []byte("Expirations"))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	scheduleKey = scheduleKey[:16]
+
+	scheduleUuid, err = DeriveUuid(scheduleKey, "Schedule")
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return scheduleKey, scheduleUuid, nil
+}
+
+// getNames returns the list of filenames at listUuid, encrypted with
+// listKey, along with its stored bytes. A missing list is empty.
+func getNames(listKey []byte, listUuid uuid.UUID) (names []string, stored []byte, err error) {
+	stored, ok := store.Get(listUuid)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	err = UnmarshalAuthDec(listKey, stored, &names)
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, stored, nil
+}
+
+// updateNames rewrites the list of filenames at listUuid with update,
+// retrying when another session of the user changes it in between.
+func updateNames(listKey []byte, listUuid uuid.UUID, update func(names []string) []string) (err error) {
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		names, stored_names, err := getNames(listKey, listUuid)
+		if err != nil {
+			return err
+		}
+
+		storable_names, err := MarshalAuthEnc(update(names), listKey)
+		if err != nil {
+			return err
+		}
+
+		if store.CompareAndSwap(listUuid, stored_names, storable_names) {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+// updateSchedule rewrites the schedule with update, retrying when another
+// session of the user changes it in between.
+func (userdata *User) updateSchedule(update func(filenames []string) []string) (err error) {
+	scheduleKey, scheduleUuid, err := scheduleKeys(userdata.FilenameKey)
+	if err != nil {
+		return err
+	}
+	return updateNames(scheduleKey, scheduleUuid, update)
+}
+
+// schedule adds filename to the user's schedule.
+func (userdata *User) schedule(filename string) (err error) {
+	return userdata.updateSchedule(func(filenames []string) []string {
+		for _, scheduled := range filenames {
+			if scheduled == filename {
+				return filenames
+			}
+		}
+		return append(filenames, filename)
+	})
+}
+
+// EnforceExpirations revokes every grant below the caller whose access has
+// expired, in every file they made an expiring grant for. Files with no
+// expiring grants left are dropped from the schedule. A file that fails
+// stays scheduled and the others are still swept; the errors are returned
+// together.
+func (userdata *User) EnforceExpirations() (err error) {
+	scheduleKey, scheduleUuid, err := scheduleKeys(userdata.FilenameKey)
+	if err != nil {
+		return err
+	}
+
+	filenames, stored_schedule, err := getNames(scheduleKey, scheduleUuid)
+	if err != nil || stored_schedule == nil {
+		return err
+	}
+
+	var errs []error
+	done := make(map[string]bool)
+	for _, filename := range filenames {
+		pending, err := userdata.enforceExpirations(filename)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filename, err))
+			continue
+		}
+		if !pending {
+			done[filename] = true
+		}
+	}
+
+	err = userdata.updateSchedule(func(filenames []string) []string {
+		kept := make([]string, 0, len(filenames))
+		for _, filename := range filenames {
+			if !done[filename] {
+				kept = append(kept, filename)
+			}
+		}
+		return kept
+	})
+	return errors.Join(append(errs, err)...)
+}
+
+// enforceExpirations cuts off the expired grants below the caller in
+// filename in one revocation, and reports whether any grant there is
+// still to expire.
+func (userdata *User) enforceExpirations(filename string) (pending bool, err error) {
+	_, _, ok, err := userdata.getSlot(filename)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := userdata.openFile(filename)
+	if err != nil {
+		return true, err
+	}
+
+	record, err := GetOwnerRecord(file.NodeKey)
+	if err != nil {
+		return true, err
+	}
+
+	sharedTo, err := GetSharedTo(file.NodeKey)
+	if err != nil {
+		return true, err
+	}
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+	cut, pending, err := cutExpired(userdata.Username, file.NodeKey, sharedTo, record, &entry)
+	if err != nil || !cut {
+		return true, err
+	}
+
+	err = userdata.finishRevocation(filename, file, sharedTo, entry)
+	if err != nil {
+		return true, err
+	}
+	return pending, nil
+}
+
+// cutExpired adds to entry the removal of every sharee below sharedTo
+// (stored under NodeKey, shared by sharedBy) whose access has ended, with
+// everyone below them. It reports whether it cut anyone, and whether any
+// grant left is still to expire. The grantees may have tampered with their
+// blobs to keep their grants from expiring, so like dropSubtree, a subtree
+// whose grants or ShareMap can't be read is cut as if it had expired.
+func cutExpired(sharedBy string, NodeKey []byte, sharedTo ShareMap, record OwnerRecord, entry *journalEntry) (cut bool, pending bool, err error) {
+	changed := false
+	for username, uNodeKey := range sharedTo {
+		var grant Grant
+		var uSharedTo ShareMap
+		chain, err := GetGrants(uNodeKey)
+		if err == nil {
+			grant, err = chain.verify(record)
+		}
+		if err == nil {
+			uSharedTo, err = GetSharedTo(uNodeKey)
+		}
+
+		if err != nil || grant.Grantee != username || grant.Grantor != sharedBy || grant.accessExpired() {
+			err = dropSubtree(uNodeKey, entry)
+			if err != nil {
+				return false, false, err
+			}
+			delete(sharedTo, username)
+			changed = true
+			continue
+		}
+		if !grant.Until.IsZero() {
+			pending = true
+		}
+
+		uCut, uPending, err := cutExpired(username, uNodeKey, uSharedTo, record, entry)
+		if err != nil {
+			return false, false, err
+		}
+		cut = cut || uCut
+		pending = pending || uPending
+	}
+
+	if changed {
+		sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
+		if err != nil {
+			return false, false, err
+		}
+
+		entry.Sets[sharedToUuid], err = MarshalAuthEnc(sharedTo, NodeKey)
+		if err != nil {
+			return false, false, err
+		}
+	}
+	return cut || changed, pending, nil
+}
@@ -0,0 +1,365 @@
+package client
+
+import (
+	"errors"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+var ErrUnindexedFiles = errors.New("the namespace has files from before the filename index, add them with IndexFilenames")
+
+// Every user keeps an index of the filenames in their namespace, so that
+// RotateFilenameKey can find every NodeKey. A name goes in within the same
+// journal entry that stores its NodeKey and comes out after the NodeKey is
+// deleted, so the index may list a name that is gone but never misses one.
+// Users made before the index existed have files it misses, until they
+// are added with IndexFilenames.
+func fileIndexKey(filenameKey []byte) (indexKey []byte, indexUuid uuid.UUID, err error) {
+	indexKey, err = userlib.HashKDF(filenameKey, []byte("FileIndex"))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	indexKey = indexKey[:16]
+
+	indexUuid, err = DeriveUuid(indexKey, "FileIndex")
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return indexKey, indexUuid, nil
+}
+
+// getIndex returns the user's index, which maps every filename to the
+// location of its NodeKey, along with its stored bytes.
+func getIndex(indexKey []byte, indexUuid uuid.UUID) (index map[string]uuid.UUID, stored []byte, err error) {
+	index = make(map[string]uuid.UUID)
+
+	stored, ok := store.Get(indexUuid)
+	if !ok {
+		return index, nil, nil
+	}
+
+	err = UnmarshalAuthDec(indexKey, stored, &index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return index, stored, nil
+}
+
+// updateIndex rewrites the user's index with update, retrying when another
+// session of the user changes it in between.
+func (userdata *User) updateIndex(update func(index map[string]uuid.UUID)) (err error) {
+	indexKey, indexUuid, err := fileIndexKey(userdata.FilenameKey)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		index, stored_index, err := getIndex(indexKey, indexUuid)
+		if err != nil {
+			return err
+		}
+		update(index)
+
+		storable_index, err := MarshalAuthEnc(index, indexKey)
+		if err != nil {
+			return err
+		}
+
+		if store.CompareAndSwap(indexUuid, stored_index, storable_index) {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+// addSlots adds the filenames in slots that index does not have yet, and
+// reports whether there were any.
+func addSlots(index map[string]uuid.UUID, slots map[string]uuid.UUID) (added bool) {
+	for filename, slot := range slots {
+		if _, ok := index[filename]; !ok {
+			index[filename] = slot
+			added = true
+		}
+	}
+	return added
+}
+
+// commitIndexed commits entry, which stores NodeKeys at slots, together
+// with the swap adding them to the user's index. A lost index swap means
+// another session changed the index in between, and is made up for
+// afterwards; lost only reports the swaps of entry itself.
+func (userdata *User) commitIndexed(entry journalEntry, slots map[string]uuid.UUID) (lost []int, err error) {
+	indexKey, indexUuid, err := fileIndexKey(userdata.FilenameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	index, stored_index, err := getIndex(indexKey, indexUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	// reserved slots are in the index already
+	if !addSlots(index, slots) {
+		return userdata.commit(entry)
+	}
+
+	storable_index, err := MarshalAuthEnc(index, indexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed := len(entry.Swaps)
+	entry.Swaps = append(entry.Swaps, journalSwap{Key: indexUuid, Old: stored_index, New: storable_index})
+
+	lost, err = userdata.commit(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lost) > 0 && lost[len(lost)-1] == indexed {
+		lost = lost[:len(lost)-1]
+		err = userdata.updateIndex(func(index map[string]uuid.UUID) {
+			addSlots(index, slots)
+		})
+		if err != nil {
+			return lost, err
+		}
+	}
+	return lost, nil
+}
+
+// IndexFilenames adds filenames, stored before the caller's namespace had
+// an index, to the index, and from then on takes the index to be complete.
+// Only the caller knows their filenames, so any left out are lost to
+// RotateFilenameKey and EnableRandomNodeKeyLocations. Names that are not in
+// the namespace are skipped.
+func (userdata *User) IndexFilenames(filenames []string) (err error) {
+	if userdata.randomNodeKeys() {
+		return nil
+	}
+
+	slots := make(map[string]uuid.UUID)
+	for _, filename := range filenames {
+		slot, err := DeriveUuid(userdata.FilenameKey, filename)
+		if err != nil {
+			return err
+		}
+		if _, ok := store.Get(slot); ok {
+			slots[filename] = slot
+		}
+	}
+
+	err = userdata.updateIndex(func(index map[string]uuid.UUID) {
+		addSlots(index, slots)
+	})
+	if err != nil {
+		return err
+	}
+
+	if userdata.Indexed {
+		return nil
+	}
+	userdata.Indexed = true
+	err = userdata.storeUser()
+	if err != nil {
+		userdata.Indexed = false
+		return err
+	}
+	return nil
+}
+
+// unindex drops filename from the user's index once its NodeKey is gone.
+func (userdata *User) unindex(filename string) (err error) {
+	userdata.updateSlots(func(slots map[string]uuid.UUID) {
+		delete(slots, filename)
+	})
+	return userdata.updateIndex(func(index map[string]uuid.UUID) {
+		delete(index, filename)
+	})
+}
+
+// RotateFilenameKey moves every NodeKey in the caller's namespace, along
+// with their index and expiry schedule, under a new FilenameKey, and
+// deletes everything that was stored under the old one. The NodeKeys
+// themselves stay the same, so whoever read them with a leaked FilenameKey
+// keeps the access they give. It fails with ErrUnindexedFiles while the
+// namespace may have files the index misses. No other
+// operation of the user, in this or another session, may run during it,
+// and other sessions must log in again afterwards.
+//
+// The rotation is recorded in the User struct before anything moves, so a
+// GetUser after a crash finishes it.
+func (userdata *User) RotateFilenameKey() (err error) {
+	if !userdata.Indexed {
+		return ErrUnindexedFiles
+	}
+
+	// the journal stays behind with the old key, so it must be empty
+	pending, err := userdata.recoverJournal()
+	if err != nil {
+		return err
+	}
+	if pending {
+		return ErrJournalBusy
+	}
+
+	userdata.NextFilenameKey = userlib.RandomBytes(16)
+	err = userdata.storeUser()
+	if err != nil {
+		userdata.NextFilenameKey = nil
+		return err
+	}
+
+	return userdata.finishFilenameKeyRotation()
+}
+
+// finishFilenameKeyRotation carries on with a rotation from wherever it
+// stands: with a NextFilenameKey, the namespace is copied under it and it
+// becomes the FilenameKey; with a PrevFilenameKey, what was stored under
+// that is deleted. Each step can be repeated.
+func (userdata *User) finishFilenameKeyRotation() (err error) {
+	if userdata.NextFilenameKey != nil {
+		err = userdata.copyNamespace(userdata.FilenameKey, userdata.NextFilenameKey)
+		if err != nil {
+			return err
+		}
+
+		userdata.PrevFilenameKey = userdata.FilenameKey
+		userdata.FilenameKey = userdata.NextFilenameKey
+		userdata.NextFilenameKey = nil
+		userdata.forgetSlots()
+		err = userdata.storeUser()
+		if err != nil {
+			return err
+		}
+	}
+
+	if userdata.PrevFilenameKey != nil {
+		err = dropNamespace(userdata.PrevFilenameKey)
+		if err != nil {
+			return err
+		}
+
+		userdata.PrevFilenameKey = nil
+		err = userdata.storeUser()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyNamespace stores every indexed NodeKey, the index and the schedule
+// under newKey as well as oldKey. A repeated attempt reuses the locations
+// of the first.
+func (userdata *User) copyNamespace(oldKey []byte, newKey []byte) (err error) {
+	oldIndexKey, oldIndexUuid, err := fileIndexKey(oldKey)
+	if err != nil {
+		return err
+	}
+	newIndexKey, newIndexUuid, err := fileIndexKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	index, _, err := getIndex(oldIndexKey, oldIndexUuid)
+	if err != nil {
+		return err
+	}
+	copied, _, err := getIndex(newIndexKey, newIndexUuid)
+	if err != nil {
+		return err
+	}
+
+	sets := make(map[uuid.UUID][]byte)
+	newIndex := make(map[string]uuid.UUID)
+	for filename, oldSlot := range index {
+		stored_NodeKey, ok := store.Get(oldSlot)
+		if !ok {
+			continue
+		}
+
+		// group refs are stored in the slot just like NodeKeys
+		NodeKey, err := AuthDec(oldKey, stored_NodeKey)
+		if err != nil {
+			return err
+		}
+
+		newSlot, ok := copied[filename]
+		if !ok {
+			newSlot, err = userdata.newSlot(newKey, filename)
+			if err != nil {
+				return err
+			}
+		}
+
+		sets[newSlot], err = AuthEnc(newKey, NodeKey)
+		if err != nil {
+			return err
+		}
+		newIndex[filename] = newSlot
+	}
+
+	sets[newIndexUuid], err = MarshalAuthEnc(newIndex, newIndexKey)
+	if err != nil {
+		return err
+	}
+
+	oldScheduleKey, oldScheduleUuid, err := scheduleKeys(oldKey)
+	if err != nil {
+		return err
+	}
+	newScheduleKey, newScheduleUuid, err := scheduleKeys(newKey)
+	if err != nil {
+		return err
+	}
+
+	scheduled, stored_schedule, err := getNames(oldScheduleKey, oldScheduleUuid)
+	if err != nil {
+		return err
+	}
+	if stored_schedule != nil {
+		sets[newScheduleUuid], err = MarshalAuthEnc(scheduled, newScheduleKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	setMany(sets)
+	return nil
+}
+
+// dropNamespace deletes everything stored under oldKey, the index last so
+// a repeated attempt still finds the NodeKeys.
+func dropNamespace(oldKey []byte) (err error) {
+	indexKey, indexUuid, err := fileIndexKey(oldKey)
+	if err != nil {
+		return err
+	}
+
+	index, _, err := getIndex(indexKey, indexUuid)
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range index {
+		store.Delete(slot)
+	}
+
+	_, scheduleUuid, err := scheduleKeys(oldKey)
+	if err != nil {
+		return err
+	}
+	store.Delete(scheduleUuid)
+
+	_, journalIndexUuid, err := journalKeys(oldKey)
+	if err != nil {
+		return err
+	}
+	store.Delete(journalIndexUuid)
+
+	store.Delete(indexUuid)
+	return nil
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Grant is one invitation in the chain that gave a user a file: what
+// Grantor allowed Grantee to do, signed by Grantor. Depth is how many more
+// levels of resharing the grantee may create below themselves. Invitation
+// is where the invitation was stored, and is gone once it was accepted.
+// AcceptBy, unless zero, is when the invitation expires, and Until when
+// the access it gives does.
+type Grant struct {
+	Grantor    string
+	Grantee    string
+	Perms      Permission
+	Depth      int
+	Invitation uuid.UUID
+	AcceptBy   time.Time
+	Until      time.Time
+	Sig        []byte
+}
+
+// GrantChain leads from the owner to a sharee, one Grant per invitation.
+// It is stored next to the sharee's UserFileNode, at a uuid derived from
+// their NodeKey. The owner has none.
+type GrantChain []Grant
+
+// UnlimitedReshare is the Depth of a grant whose grantee may reshare to any
+// depth.
+const UnlimitedReshare = -1
+
+// WithReshareDepth limits how deep the recipient may reshare the file: 0
+// means not at all, 1 only to users who cannot reshare further. It can
+// only narrow the sender's own limit.
+func WithReshareDepth(depth int) InviteOption {
+	return func(options *inviteOptions) {
+		options.depth = depth
+		options.depthSet = true
+	}
+}
+
+// WithInvitationExpiry makes the invitation unusable after deadline.
+func WithInvitationExpiry(deadline time.Time) InviteOption {
+	return func(options *inviteOptions) {
+		options.acceptBy = deadline
+	}
+}
+
+// WithAccessExpiry makes the recipient's access, and that of everyone they
+// share with, end at deadline. The sender's EnforceExpirations revokes it
+// once the deadline has passed.
+func WithAccessExpiry(deadline time.Time) InviteOption {
+	return func(options *inviteOptions) {
+		options.until = deadline
+	}
+}
+
+func (grant Grant) signed(fileID uuid.UUID) []byte {
+	return []byte(fmt.Sprintf("%s %d:%s %d:%s %d %d %s %s %s", fileID, len(grant.Grantor), grant.Grantor,
+		len(grant.Grantee), grant.Grantee, grant.Perms, grant.Depth, grant.Invitation,
+		grant.AcceptBy.UTC().Format(time.RFC3339Nano), grant.Until.UTC().Format(time.RFC3339Nano)))
+}
+
+// accessExpired reports whether the access grant gives has ended.
+func (grant Grant) accessExpired() bool {
+	return !grant.Until.IsZero() && !now().Before(grant.Until)
+}
+
+// inviteExpired reports whether the invitation for grant can no longer be
+// accepted.
+func (grant Grant) inviteExpired() bool {
+	return !grant.AcceptBy.IsZero() && now().After(grant.AcceptBy)
+}
+
+func (grant *Grant) sign(fileID uuid.UUID, signer *User) (err error) {
+	grant.Sig, err = signer.sign(grant.signed(fileID))
+	return err
+}
+
+// canReshare reports whether grant lets its grantee invite others.
+func (grant Grant) canReshare() bool {
+	return grant.Perms&PermReshare != 0 && grant.Depth != 0
+}
+
+// narrows reports whether grant gives no more than parent, the grant of
+// the user who made it, allows to pass on.
+func (grant Grant) narrows(parent Grant) bool {
+	if grant.Perms&^parent.Perms != 0 {
+		return false
+	}
+	if !parent.Until.IsZero() && (grant.Until.IsZero() || grant.Until.After(parent.Until)) {
+		return false
+	}
+	if parent.Depth == UnlimitedReshare {
+		return true
+	}
+	return grant.Depth != UnlimitedReshare && grant.Depth < parent.Depth
+}
+
+// GetGrants retrieves the chain stored with the node under NodeKey.
+func GetGrants(NodeKey []byte) (chain GrantChain, err error) {
+
+	chainUuid, err := DeriveUuid(NodeKey, "Grants")
+	if err != nil {
+		return nil, err
+	}
+
+	stored_chain, ok := store.Get(chainUuid)
+	if !ok {
+		return nil, nil
+	}
+
+	err = UnmarshalAuthDec(NodeKey, stored_chain, &chain)
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// verify checks every signature in chain and that each grant only narrows
+// the one before it, starting from the owner named by record, and returns
+// the grant at its end. The owner's is an unlimited grant to themselves.
+func (chain GrantChain) verify(record OwnerRecord) (last Grant, err error) {
+	last = Grant{Grantee: record.Owner, Perms: PermAll, Depth: UnlimitedReshare}
+
+	for _, grant := range chain {
+		if grant.Grantor != last.Grantee || !last.canReshare() || !grant.narrows(last) {
+			return last, errors.New("grant chain does not lead from the owner")
+		}
+
+		err = verifyBy(grant.Grantor, grant.signed(record.FileID), grant.Sig)
+		if err != nil {
+			return last, errors.New("grant not signed by its grantor")
+		}
+		last = grant
+	}
+	return last, nil
+}
+
+// grantOf returns the verified grant by which username holds the node
+// under NodeKey, along with the chain leading to it.
+func grantOf(NodeKey []byte, username string) (grant Grant, chain GrantChain, record OwnerRecord, err error) {
+	record, err = GetOwnerRecord(NodeKey)
+	if err != nil {
+		return grant, nil, record, err
+	}
+
+	chain, err = GetGrants(NodeKey)
+	if err != nil {
+		return grant, nil, record, err
+	}
+
+	grant, err = chain.verify(record)
+	if err != nil {
+		return grant, nil, record, err
+	}
+	if grant.Grantee != username {
+		return grant, nil, record, errors.New("grant chain leads to someone else")
+	}
+	return grant, chain, record, nil
+}
+
+// newGrant is the grant the user, holding the file by sGrant, makes for
+// recipient under opts, to be stored at invitationPtr.
+func (userdata *User) newGrant(sGrant Grant, fileID uuid.UUID, recipient string, invitationPtr uuid.UUID, opts inviteOptions) (grant Grant, err error) {
+	if !sGrant.canReshare() {
+		return grant, ErrPermissionDenied
+	}
+
+	grant = Grant{Grantor: userdata.Username, Grantee: recipient, Perms: sGrant.Perms, Depth: sGrant.Depth,
+		Invitation: invitationPtr, AcceptBy: opts.acceptBy, Until: sGrant.Until}
+	if !opts.until.IsZero() {
+		grant.Until = opts.until
+	}
+	if opts.perms != 0 {
+		grant.Perms = opts.perms
+	}
+	if grant.Depth != UnlimitedReshare {
+		grant.Depth--
+	}
+	if opts.depthSet {
+		if opts.depth < UnlimitedReshare {
+			return grant, errors.New("invalid reshare depth")
+		}
+		grant.Depth = opts.depth
+	}
+	if grant.Depth == 0 {
+		grant.Perms &^= PermReshare
+	}
+
+	if !grant.narrows(sGrant) {
+		return grant, ErrPermissionDenied
+	}
+
+	err = grant.sign(fileID, userdata)
+	if err != nil {
+		return grant, err
+	}
+	return grant, nil
+}
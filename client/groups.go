@@ -0,0 +1,834 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Group is a named set of users that files can be shared with as a single
+// recipient, GroupRecipient(Name). It has a key pair of its own, whose
+// private key is wrapped for every member with their public key.
+// RekeyGroupWithout only replaces the group's keys, no file is re-keyed, so
+// it does not revoke what the member left out already opened. Previous is the private key
+// the group had before its last change, wrapped for the admin only, to
+// re-wrap invitations made for it.
+type Group struct {
+	Name      string
+	Admin     string
+	Epoch     int
+	PublicKey userlib.PKEEncKey
+	Members   map[string][]byte
+	Previous  []byte
+}
+
+// A group is stored at a uuid derived from its admin, who created it, and
+// its name, as a storedGroup: the public key in the clear, for senders to
+// seal invitations with, and the rest of the Group encrypted with a fresh
+// group key, which is wrapped for every member with their public key in no
+// particular order. The admin signs it all along with where it is stored,
+// so nothing in the clear names the group, its admin or its members.
+type storedGroup struct {
+	PublicKey userlib.PKEEncKey
+	Keys      [][]byte
+	Group_enc []byte
+	Sig       []byte
+}
+
+const groupPrefix = "group:"
+
+var ErrNoSuchGroup = errors.New("no such group")
+var ErrGroupExists = errors.New("group already exists")
+var ErrNotGroupMember = errors.New("not a member of the group")
+
+// GroupRecipient is the name a file is shared with admin's group name
+// under, in CreateInvitation and RevokeAccess.
+func GroupRecipient(admin string, name string) string {
+	return groupPrefix + admin + "/" + name
+}
+
+func isGroup(recipient string) bool {
+	return strings.HasPrefix(recipient, groupPrefix)
+}
+
+// splitGroupRecipient returns the admin and name of the group recipient
+// was made from. Group names cannot hold a "/", usernames can.
+func splitGroupRecipient(recipient string) (admin string, name string, err error) {
+	qualified := strings.TrimPrefix(recipient, groupPrefix)
+	i := strings.LastIndex(qualified, "/")
+	if !isGroup(recipient) || i < 0 {
+		return "", "", ErrNoSuchGroup
+	}
+	return qualified[:i], qualified[i+1:], nil
+}
+
+// groupUuids returns where admin's group name is stored, and the list of
+// invitations made for it.
+func groupUuids(admin string, name string) (groupUuid uuid.UUID, filesUuid uuid.UUID, err error) {
+	base := userlib.Hash([]byte(GroupRecipient(admin, name)))[:16]
+
+	groupUuid, err = DeriveUuid(base, "Group")
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+
+	filesUuid, err = DeriveUuid(base, "GroupFiles")
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	return groupUuid, filesUuid, nil
+}
+
+func (stored storedGroup) signed(groupUuid uuid.UUID) ([]byte, error) {
+	stored.Sig = nil
+	signed, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("group "+groupUuid.String()+" "), signed...), nil
+}
+
+// sealGroup encrypts group for its members and signs it.
+func (userdata *User) sealGroup(group Group) (storable_group []byte, err error) {
+	groupUuid, _, err := groupUuids(group.Admin, group.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	groupKey := userlib.RandomBytes(16)
+	stored := storedGroup{PublicKey: group.PublicKey}
+	for member := range group.Members {
+		publicKey, ok := publicKeyOf(member)
+		if !ok {
+			return nil, ErrNoSuchUser
+		}
+
+		wrapped, err := userlib.PKEEnc(publicKey, groupKey)
+		if err != nil {
+			return nil, err
+		}
+		stored.Keys = append(stored.Keys, wrapped)
+	}
+
+	stored.Group_enc, err = MarshalAuthEnc(group, groupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := stored.signed(groupUuid)
+	if err != nil {
+		return nil, err
+	}
+	stored.Sig, err = userdata.sign(signed)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stored)
+}
+
+// getGroup retrieves admin's group name, as stored, and verifies admin's
+// signature.
+func getGroup(admin string, name string) (stored storedGroup, stored_group []byte, err error) {
+	groupUuid, _, err := groupUuids(admin, name)
+	if err != nil {
+		return stored, nil, err
+	}
+
+	stored_group, ok := store.Get(groupUuid)
+	if !ok {
+		return stored, nil, ErrNoSuchGroup
+	}
+
+	err = json.Unmarshal(stored_group, &stored)
+	if err != nil {
+		return stored, nil, err
+	}
+
+	signed, err := stored.signed(groupUuid)
+	if err != nil {
+		return stored, nil, err
+	}
+
+	err = verifyBy(admin, signed, stored.Sig)
+	if err != nil {
+		return stored, nil, errors.New("group not signed by its admin")
+	}
+	return stored, stored_group, nil
+}
+
+// GetGroup retrieves what anyone can see of admin's group name: its public
+// key, checked against admin's signature. Members stays nil.
+func GetGroup(admin string, name string) (group Group, err error) {
+	stored, _, err := getGroup(admin, name)
+	if err != nil {
+		return group, err
+	}
+	return Group{Name: name, Admin: admin, PublicKey: stored.PublicKey}, nil
+}
+
+// openGroup retrieves admin's group name, as stored, and decrypts it for
+// the caller, who must be a member.
+func (userdata *User) openGroup(admin string, name string) (group Group, stored_group []byte, err error) {
+	stored, stored_group, err := getGroup(admin, name)
+	if err != nil {
+		return group, nil, err
+	}
+
+	for _, wrapped := range stored.Keys {
+		for _, decKey := range userdata.decKeys() {
+			groupKey, err := userlib.PKEDec(decKey, wrapped)
+			if err != nil {
+				continue
+			}
+
+			err = UnmarshalAuthDec(groupKey, stored.Group_enc, &group)
+			if err != nil {
+				return group, nil, err
+			}
+			if group.Name != name || group.Admin != admin {
+				return group, nil, errors.New("group stored under another name")
+			}
+			return group, stored_group, nil
+		}
+	}
+	return group, nil, ErrNotGroupMember
+}
+
+// groupOf retrieves what anyone can see of the group a recipient name was
+// made from.
+func groupOf(recipient string) (group Group, err error) {
+	admin, name, err := splitGroupRecipient(recipient)
+	if err != nil {
+		return group, err
+	}
+	return GetGroup(admin, name)
+}
+
+const groupVersion = 2
+
+// wrapGroupKey encrypts the group's private key for the holder of
+// publicKey.
+func wrapGroupKey(publicKey userlib.PKEEncKey, decKey userlib.PKEDecKey) (wrapped []byte, err error) {
+	key_enc, decKey_enc, err := hybridEnc(publicKey, decKey)
+	if err != nil {
+		return nil, err
+	}
+	return appendField(appendField([]byte{groupVersion}, key_enc), decKey_enc), nil
+}
+
+func unwrapGroupKey(ownDecKeys []userlib.PKEDecKey, wrapped []byte) (decKey userlib.PKEDecKey, err error) {
+	if len(wrapped) == 0 || wrapped[0] != groupVersion {
+		return decKey, ErrInvitationFormat
+	}
+	fields, _, err := splitFields(wrapped)
+	if err != nil {
+		return decKey, err
+	}
+	if len(fields) != 2 {
+		return decKey, ErrInvitationFormat
+	}
+
+	err = hybridDec(ownDecKeys, fields[0], fields[1], &decKey)
+	return decKey, err
+}
+
+// groupKey unwraps the group's private key for the caller.
+func (userdata *User) groupKey(group Group) (decKey userlib.PKEDecKey, err error) {
+	wrapped, ok := group.Members[userdata.Username]
+	if !ok {
+		return decKey, ErrNotGroupMember
+	}
+	return unwrapGroupKey(userdata.decKeys(), wrapped)
+}
+
+// newKeys gives group a fresh key pair, wrapped for members.
+func (group *Group) newKeys(members []string) (decKey userlib.PKEDecKey, err error) {
+	group.PublicKey, decKey, err = userlib.PKEKeyGen()
+	if err != nil {
+		return decKey, err
+	}
+
+	group.Members = make(map[string][]byte)
+	for _, member := range members {
+		publicKey, ok := publicKeyOf(member)
+		if !ok {
+			return decKey, ErrNoSuchUser
+		}
+
+		group.Members[member], err = wrapGroupKey(publicKey, decKey)
+		if err != nil {
+			return decKey, err
+		}
+	}
+	return decKey, nil
+}
+
+// A user keeps the names of the groups they administer, encrypted with a
+// key derived from their password like the inbox book, so RotateKeys can
+// find the groups to sign again.
+func (userdata *User) groupListKeys() (listKey []byte, listUuid uuid.UUID, err error) {
+	listKey, err = userlib.HashKDF(userdata.userKey, []byte("Groups"))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	listKey = listKey[:16]
+
+	listUuid, err = DeriveUuid(listKey, "AdminGroups")
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return listKey, listUuid, nil
+}
+
+// CreateGroup creates the group name with the caller as its admin, and
+// the caller and members as its members.
+func (userdata *User) CreateGroup(name string, members []string) (err error) {
+	if name == "" || strings.Contains(name, "/") {
+		return errors.New("group name is empty or holds a /")
+	}
+
+	groupUuid, _, err := groupUuids(userdata.Username, name)
+	if err != nil {
+		return err
+	}
+
+	// listed first, so a crash can only leave a name in the list with no
+	// group to sign
+	listKey, listUuid, err := userdata.groupListKeys()
+	if err != nil {
+		return err
+	}
+	err = updateNames(listKey, listUuid, func(names []string) []string {
+		for _, listed := range names {
+			if listed == name {
+				return names
+			}
+		}
+		return append(names, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	group := Group{Name: name, Admin: userdata.Username}
+	_, err = group.newKeys(append([]string{userdata.Username}, members...))
+	if err != nil {
+		return err
+	}
+
+	storable_group, err := userdata.sealGroup(group)
+	if err != nil {
+		return err
+	}
+
+	if !store.CompareAndSwap(groupUuid, nil, storable_group) {
+		return ErrGroupExists
+	}
+	return nil
+}
+
+// adminGroup retrieves the caller's group name for a change, along with
+// its private key.
+func (userdata *User) adminGroup(name string) (group Group, stored_group []byte, decKey userlib.PKEDecKey, err error) {
+	group, stored_group, err = userdata.openGroup(userdata.Username, name)
+	if err != nil {
+		return group, nil, decKey, err
+	}
+
+	decKey, err = userdata.groupKey(group)
+	if err != nil {
+		return group, nil, decKey, err
+	}
+	return group, stored_group, decKey, nil
+}
+
+// swapGroup replaces the group stored as stored_group with group, sealed
+// by the caller.
+func (userdata *User) swapGroup(group Group, stored_group []byte) (err error) {
+	groupUuid, _, err := groupUuids(group.Admin, group.Name)
+	if err != nil {
+		return err
+	}
+
+	storable_group, err := userdata.sealGroup(group)
+	if err != nil {
+		return err
+	}
+
+	if !store.CompareAndSwap(groupUuid, stored_group, storable_group) {
+		return ErrConflict
+	}
+	return nil
+}
+
+// AddGroupMember gives username the current keys of the caller's group
+// name.
+func (userdata *User) AddGroupMember(name string, username string) (err error) {
+	group, stored_group, decKey, err := userdata.adminGroup(name)
+	if err != nil {
+		return err
+	}
+
+	publicKey, ok := publicKeyOf(username)
+	if !ok {
+		return ErrNoSuchUser
+	}
+
+	group.Members[username], err = wrapGroupKey(publicKey, decKey)
+	if err != nil {
+		return err
+	}
+
+	err = userdata.swapGroup(group, stored_group)
+	if err != nil {
+		return err
+	}
+	return userdata.rewrapGroupFiles(group, decKey)
+}
+
+// RekeyGroupWithout gives the caller's group name new keys, wrapped for
+// every member but username, and wraps every invitation made for the group
+// again with them, so username's client can no longer open them. It only
+// re-keys the group, not the files shared with it, so it does not revoke
+// anything: username keeps whatever NodeKeys they kept until each sharer
+// revokes the group. The admin cannot leave their own group.
+func (userdata *User) RekeyGroupWithout(name string, username string) (err error) {
+	group, stored_group, oldKey, err := userdata.adminGroup(name)
+	if err != nil {
+		return err
+	}
+	if username == group.Admin {
+		return errors.New("the admin cannot leave their group")
+	}
+	if _, ok := group.Members[username]; !ok {
+		return ErrNotGroupMember
+	}
+
+	var members []string
+	for member := range group.Members {
+		if member != username {
+			members = append(members, member)
+		}
+	}
+
+	adminKey, ok := publicKeyOf(group.Admin)
+	if !ok {
+		return ErrNoSuchUser
+	}
+	group.Previous, err = wrapGroupKey(adminKey, oldKey)
+	if err != nil {
+		return err
+	}
+
+	decKey, err := group.newKeys(members)
+	if err != nil {
+		return err
+	}
+	group.Epoch++
+
+	// the group goes first, so no invitation is ever wrapped with keys
+	// that are not the group's yet
+	err = userdata.swapGroup(group, stored_group)
+	if err != nil {
+		return err
+	}
+	return userdata.rewrapGroupFiles(group, decKey)
+}
+
+// rewrapGroupFiles wraps every invitation made for group that is still
+// wrapped with its previous keys with its current ones. That covers those
+// made while the keys were being replaced, and any a crash left behind.
+func (userdata *User) rewrapGroupFiles(group Group, decKey userlib.PKEDecKey) (err error) {
+	if group.Previous == nil {
+		return nil
+	}
+
+	previousKey, err := unwrapGroupKey(userdata.decKeys(), group.Previous)
+	if err != nil {
+		return err
+	}
+
+	_, filesUuid, err := groupUuids(group.Admin, group.Name)
+	if err != nil {
+		return err
+	}
+
+	ptrs, _, err := getGroupFiles(filesUuid)
+	if err != nil {
+		return err
+	}
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+	for _, ptr := range ptrs {
+		stored_slot, ok := store.Get(ptr)
+		if !ok {
+			continue
+		}
+
+		slot, err := splitGroupSlot(stored_slot)
+		if err != nil {
+			continue
+		}
+		if _, err := userlib.PKEDec(decKey, slot.envelopeKey_enc); err == nil {
+			continue
+		}
+
+		envelopeKey, err := userlib.PKEDec(previousKey, slot.envelopeKey_enc)
+		if err != nil {
+			continue
+		}
+
+		slot.envelopeKey_enc, err = userlib.PKEEnc(group.PublicKey, envelopeKey)
+		if err != nil {
+			return err
+		}
+		entry.Swaps = append(entry.Swaps, journalSwap{Key: ptr, Old: stored_slot, New: slot.join()})
+	}
+	if len(entry.Swaps) == 0 {
+		return nil
+	}
+
+	_, err = userdata.commit(entry)
+	return err
+}
+
+func getGroupFiles(filesUuid uuid.UUID) (ptrs []uuid.UUID, stored_files []byte, err error) {
+	stored_files, ok := store.Get(filesUuid)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	err = json.Unmarshal(stored_files, &ptrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ptrs, stored_files, nil
+}
+
+// appendGroupFile returns the swap that adds ptr to the group's list of
+// invitations at filesUuid as it is now.
+func appendGroupFile(filesUuid uuid.UUID, ptr uuid.UUID) (swap journalSwap, err error) {
+	ptrs, stored_files, err := getGroupFiles(filesUuid)
+	if err != nil {
+		return swap, err
+	}
+
+	storable_files, err := json.Marshal(append(ptrs, ptr))
+	if err != nil {
+		return swap, err
+	}
+	return journalSwap{Key: filesUuid, Old: stored_files, New: storable_files}, nil
+}
+
+// addGroupFile adds ptr to the group's list of invitations, retrying when
+// someone else changes it in between.
+func addGroupFile(filesUuid uuid.UUID, ptr uuid.UUID) (err error) {
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		swap, err := appendGroupFile(filesUuid, ptr)
+		if err != nil {
+			return err
+		}
+
+		if store.CompareAndSwap(swap.Key, swap.Old, swap.New) {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+// commitGroupInvitation commits entry, which makes the invitation for group
+// at invitationPtr, along with adding it to the group's list.
+func (userdata *User) commitGroupInvitation(group Group, invitationPtr uuid.UUID, entry journalEntry) (err error) {
+	_, filesUuid, err := groupUuids(group.Admin, group.Name)
+	if err != nil {
+		return err
+	}
+
+	swap, err := appendGroupFile(filesUuid, invitationPtr)
+	if err != nil {
+		return err
+	}
+	entry.Swaps = append(entry.Swaps, swap)
+
+	lost, err := userdata.commit(entry)
+	if err != nil {
+		return err
+	}
+	if len(lost) > 0 {
+		// like an inbox note, the invitation stands without it
+		addGroupFile(filesUuid, invitationPtr)
+	}
+	return nil
+}
+
+// An invitation made for a group is stored like a sealed invitation, with
+// the sender's name inside the envelope, for members to verify it by once
+// they decrypt it, and with the envelope key wrapped with the group's public
+// key outside the sender's signature, so the admin can wrap it again when
+// the group's keys change.
+type groupSlot struct {
+	nonce           []byte
+	envelopeKey_enc []byte
+	envelope_enc    []byte
+	sig             []byte
+}
+
+type groupEnvelope struct {
+	Sender   string
+	Envelope invitationEnvelope
+}
+
+func (slot groupSlot) join() []byte {
+	data := []byte{groupVersion}
+	for _, field := range [][]byte{slot.nonce, slot.envelopeKey_enc, slot.envelope_enc, slot.sig} {
+		data = appendField(data, field)
+	}
+	return data
+}
+
+func splitGroupSlot(data []byte) (slot groupSlot, err error) {
+	if len(data) == 0 || data[0] != groupVersion {
+		return slot, ErrInvitationFormat
+	}
+	fields, _, err := splitFields(data)
+	if err != nil {
+		return slot, err
+	}
+	if len(fields) != 4 {
+		return slot, ErrInvitationFormat
+	}
+	return groupSlot{fields[0], fields[1], fields[2], fields[3]}, nil
+}
+
+func (slot groupSlot) signed(sender string, group Group, invitationPtr uuid.UUID) []byte {
+	signed := appendField(appendField([]byte{groupVersion}, slot.nonce), slot.envelope_enc)
+	return invitationSigned(sender, GroupRecipient(group.Admin, group.Name), invitationPtr, signed)
+}
+
+// sealGroupSlot encrypts envelope for group, to be stored at invitationPtr,
+// and signs it.
+func (userdata *User) sealGroupSlot(group Group, invitationPtr uuid.UUID, envelope invitationEnvelope) (sealed []byte, err error) {
+	slot := groupSlot{nonce: userlib.RandomBytes(16)}
+
+	slot.envelopeKey_enc, slot.envelope_enc, err = hybridEnc(group.PublicKey, groupEnvelope{userdata.Username, envelope})
+	if err != nil {
+		return nil, err
+	}
+
+	slot.sig, err = userdata.sign(slot.signed(userdata.Username, group, invitationPtr))
+	if err != nil {
+		return nil, err
+	}
+	return slot.join(), nil
+}
+
+// openGroupSlot decrypts the envelope sealed for group at invitationPtr and
+// verifies it against the signature of the sender it names.
+func openGroupSlot(group Group, decKey userlib.PKEDecKey, invitationPtr uuid.UUID) (sender string, envelope invitationEnvelope, err error) {
+	data, ok := store.Get(invitationPtr)
+	if !ok {
+		return "", envelope, errors.New("no invitationPTr")
+	}
+
+	slot, err := splitGroupSlot(data)
+	if err != nil {
+		return "", envelope, err
+	}
+
+	var sealed groupEnvelope
+	err = hybridDec([]userlib.PKEDecKey{decKey}, slot.envelopeKey_enc, slot.envelope_enc, &sealed)
+	if err != nil {
+		return "", envelope, err
+	}
+
+	err = verifyBy(sealed.Sender, slot.signed(sealed.Sender, group, invitationPtr), slot.sig)
+	if err != nil {
+		return "", envelope, errors.New("DSVerify fail")
+	}
+	return sealed.Sender, sealed.Envelope, nil
+}
+
+// A member's namespace holds, instead of the NodeKey of a file shared with
+// one of their groups, a reference to the invitation made for the group.
+// It is resolved through the group on every access, so the client of a
+// member the group was re-keyed without no longer finds the file.
+var groupRefMarker = []byte("group-ref:")
+
+type groupRef struct {
+	Group         string
+	Admin         string
+	Sender        string
+	InvitationPtr uuid.UUID
+}
+
+// resolveNodeKey returns the NodeKey stored in a namespace slot, resolving
+// a group reference, and reports whether it was one.
+func (userdata *User) resolveNodeKey(stored []byte) (NodeKey []byte, viaGroup bool, err error) {
+	if len(stored) == 16 || !bytes.HasPrefix(stored, groupRefMarker) {
+		return stored, false, nil
+	}
+
+	var ref groupRef
+	err = json.Unmarshal(stored[len(groupRefMarker):], &ref)
+	if err != nil {
+		return nil, true, err
+	}
+
+	group, _, err := userdata.openGroup(ref.Admin, ref.Group)
+	if err != nil {
+		return nil, true, err
+	}
+
+	sender, envelope, err := userdata.openGroupInvitation(group, ref.InvitationPtr)
+	if err != nil {
+		return nil, true, err
+	}
+	if sender != ref.Sender {
+		return nil, true, errors.New("invitation is from someone else")
+	}
+	return envelope.NodeKey, true, nil
+}
+
+// openGroupInvitation opens the invitation made for group at
+// invitationPtr, and returns it with its sender.
+func (userdata *User) openGroupInvitation(group Group, invitationPtr uuid.UUID) (sender string, envelope invitationEnvelope, err error) {
+	decKey, err := userdata.groupKey(group)
+	if err != nil {
+		return "", envelope, err
+	}
+	return openGroupSlot(group, decKey, invitationPtr)
+}
+
+// getNodeKey returns the NodeKey filename is stored under in the caller's
+// namespace.
+func (userdata *User) getNodeKey(filename string) (NodeKey []byte, err error) {
+	_, stored_NodeKey, ok, err := userdata.getSlot(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New(filename + "not in users'namespace")
+	}
+
+	stored, err := AuthDec(userdata.FilenameKey, stored_NodeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	NodeKey, _, err = userdata.resolveNodeKey(stored)
+	return NodeKey, err
+}
+
+// inspectGroupInvitation opens the invitation made for group at
+// invitationPtr and checks it against its sender's grant.
+func (userdata *User) inspectGroupInvitation(group Group, invitationPtr uuid.UUID) (sender string, envelope invitationEnvelope, grant Grant, err error) {
+	sender, envelope, err = userdata.openGroupInvitation(group, invitationPtr)
+	if err != nil {
+		return "", envelope, grant, err
+	}
+
+	grant, _, _, err = grantOf(envelope.NodeKey, GroupRecipient(group.Admin, group.Name))
+	if err != nil {
+		return "", envelope, grant, err
+	}
+	if grant.Grantor != sender {
+		return "", envelope, grant, errors.New("invitation does not match its grant")
+	}
+
+	envelope.Details.Perms = grant.Perms
+	return sender, envelope, grant, nil
+}
+
+// ListGroupInvitations returns the files shared with admin's group name
+// that the caller, a member, can still accept with AcceptGroupInvitation.
+func (userdata *User) ListGroupInvitations(admin string, name string) (entries []InboxEntry, err error) {
+	group, _, err := userdata.openGroup(admin, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, filesUuid, err := groupUuids(admin, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ptrs, _, err := getGroupFiles(filesUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ptr := range ptrs {
+		sender, envelope, grant, err := userdata.inspectGroupInvitation(group, ptr)
+		if err == ErrNotGroupMember {
+			return nil, err
+		}
+		if err != nil || grant.accessExpired() {
+			continue
+		}
+		entries = append(entries, InboxEntry{sender, ptr, envelope.Details})
+	}
+	return entries, nil
+}
+
+// AcceptGroupInvitation stores the file senderUsername shared with admin's
+// group name, of which the caller is a member, as filename. The caller
+// keeps access for as long as they stay in the group.
+func (userdata *User) AcceptGroupInvitation(admin string, name string, senderUsername string, invitationPtr uuid.UUID, filename string) (err error) {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = userdata.checkFree(filename)
+	if err != nil {
+		return err
+	}
+
+	group, _, err := userdata.openGroup(admin, name)
+	if err != nil {
+		return err
+	}
+
+	sender, envelope, grant, err := userdata.inspectGroupInvitation(group, invitationPtr)
+	if err != nil {
+		return err
+	}
+	if sender != senderUsername {
+		return errors.New("invitation is from someone else")
+	}
+	if grant.accessExpired() {
+		return ErrInvitationExpired
+	}
+
+	ref, err := json.Marshal(groupRef{name, admin, senderUsername, invitationPtr})
+	if err != nil {
+		return err
+	}
+
+	storable_ref, err := AuthEnc(userdata.FilenameKey, append(append([]byte{}, groupRefMarker...), ref...))
+	if err != nil {
+		return err
+	}
+
+	NodeKeyUuid, err := userdata.freeSlot(filename)
+	if err != nil {
+		return err
+	}
+
+	entry := journalEntry{Sets: map[uuid.UUID][]byte{NodeKeyUuid: storable_ref}}
+
+	err = userdata.markAccepted(envelope.NodeKey, entry.Sets)
+	if err != nil {
+		return err
+	}
+
+	_, err = userdata.commitIndexed(entry, map[string]uuid.UUID{filename: NodeKeyUuid})
+	if err != nil {
+		return err
+	}
+	userdata.getCache().forget(filename)
+	return nil
+}
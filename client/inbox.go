@@ -0,0 +1,475 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Every user has an inbox, at a uuid anyone can derive from their username,
+// where CreateInvitation leaves a note of each invitation. Each note is a
+// blob of its own, and the inbox is only the list of those uuids, so it
+// stays small however many notes come in. A note holds the sender,
+// invitationPtr, the note's number among those the sender left for the
+// recipient and when it was sent, encrypted for the recipient like an
+// invitation envelope, as a version byte followed by the encrypted key, the
+// encrypted note and the sender's signature over both. The note is stored
+// at a uuid derived from the sender, the recipient and its number. Anyone
+// can write to an inbox, so ListInvitations ignores whatever it lists that
+// the sender did not sign, and looks up the notes it expects by number.
+const inboxVersion = 3
+
+type inboxNote struct {
+	Sender        string
+	InvitationPtr uuid.UUID
+	Seq           int
+	Sent          int64
+}
+
+// InboxEntry is a pending invitation found in the caller's inbox, to be
+// passed to AcceptInvitation.
+type InboxEntry struct {
+	Sender        string
+	InvitationPtr uuid.UUID
+	Details       InvitationDetails
+}
+
+// ErrNoteRemoved is returned, for each note, when a note that was left in
+// the caller's inbox is gone without having been dealt with.
+var ErrNoteRemoved = errors.New("a note was removed from the inbox")
+
+func inboxUuid(username string) (uuid.UUID, error) {
+	return DeriveUuid(userlib.Hash([]byte(username))[:16], "Inbox")
+}
+
+// noteLocation returns where the seq-th note from sender to recipient is
+// stored.
+func noteLocation(sender string, recipient string, seq int) (uuid.UUID, error) {
+	pair := fmt.Sprintf("%d:%s %s", len(sender), sender, recipient)
+	return DeriveUuid(userlib.Hash([]byte(pair))[:16], "Note "+strconv.Itoa(seq))
+}
+
+// noteSigned is what the sender signs, binding the note to its recipient
+// and to where it is stored.
+func noteSigned(recipient string, noteUuid uuid.UUID, note_key_enc []byte, note_enc []byte) []byte {
+	context := fmt.Sprintf("note %d:%s %s ", len(recipient), recipient, noteUuid)
+	return appendField(appendField([]byte(context), note_key_enc), note_enc)
+}
+
+// A user keeps, encrypted with a key derived from their password, a count
+// of the notes they have left for each recipient, in a blob of its own per
+// recipient, and an inbox book of the notes of each sender they have seen.
+type inboxBook struct {
+	Seen map[string]seenNotes
+}
+
+// seenNotes are the notes of one sender: the highest number seen, and the
+// numbers of those still pending.
+type seenNotes struct {
+	Last    int
+	Pending []int
+}
+
+func (userdata *User) bookKeys() (bookKey []byte, bookUuid uuid.UUID, err error) {
+	bookKey, err = userlib.HashKDF(userdata.userKey, []byte("Inbox"))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	bookKey = bookKey[:16]
+
+	bookUuid, err = DeriveUuid(bookKey, "InboxBook")
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return bookKey, bookUuid, nil
+}
+
+// sentUuid returns where the user's count of notes left for recipient is
+// stored.
+func sentUuid(bookKey []byte, recipient string) (uuid.UUID, error) {
+	return DeriveUuid(bookKey, "Sent "+recipient)
+}
+
+// getBook returns the user's inbox book along with its stored bytes. A
+// missing book is empty.
+func (userdata *User) getBook() (book inboxBook, stored_book []byte, err error) {
+	bookKey, bookUuid, err := userdata.bookKeys()
+	if err != nil {
+		return book, nil, err
+	}
+
+	book = inboxBook{Seen: make(map[string]seenNotes)}
+	stored_book, ok := store.Get(bookUuid)
+	if !ok {
+		return book, nil, nil
+	}
+	err = UnmarshalAuthDec(bookKey, stored_book, &book)
+	if err != nil {
+		return book, nil, err
+	}
+	if book.Seen == nil {
+		book.Seen = make(map[string]seenNotes)
+	}
+	return book, stored_book, nil
+}
+
+func sameSeqs(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateBook rewrites the user's inbox book with update, unless update
+// reports no change, retrying when another session of the user changes it
+// in between.
+func (userdata *User) updateBook(update func(book *inboxBook) bool) (err error) {
+	bookKey, bookUuid, err := userdata.bookKeys()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		book, stored_book, err := userdata.getBook()
+		if err != nil {
+			return err
+		}
+
+		if !update(&book) {
+			return nil
+		}
+		storable_book, err := MarshalAuthEnc(book, bookKey)
+		if err != nil {
+			return err
+		}
+
+		if store.CompareAndSwap(bookUuid, stored_book, storable_book) {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+// newNote seals and signs the next note for recipient, of the invitation
+// at invitationPtr. It returns the swap that stores the note, which loses
+// if another session of the user took its number first, and the swap that
+// counts it, along with the location of the recipient's inbox.
+func (userdata *User) newNote(recipient string, rPublicKey userlib.PKEEncKey, invitationPtr uuid.UUID) (rInboxUuid uuid.UUID, noteSwap journalSwap, sentSwap journalSwap, err error) {
+	bookKey, _, err := userdata.bookKeys()
+	if err != nil {
+		return uuid.Nil, noteSwap, sentSwap, err
+	}
+	countUuid, err := sentUuid(bookKey, recipient)
+	if err != nil {
+		return uuid.Nil, noteSwap, sentSwap, err
+	}
+	var seq int
+	stored_sent, ok := store.Get(countUuid)
+	if ok {
+		err = UnmarshalAuthDec(bookKey, stored_sent, &seq)
+		if err != nil {
+			return uuid.Nil, noteSwap, sentSwap, err
+		}
+	}
+	seq++
+	storable_sent, err := MarshalAuthEnc(seq, bookKey)
+	if err != nil {
+		return uuid.Nil, noteSwap, sentSwap, err
+	}
+
+	note_key_enc, note_enc, err := hybridEnc(rPublicKey, inboxNote{userdata.Username, invitationPtr, seq, now().UnixNano()})
+	if err != nil {
+		return uuid.Nil, noteSwap, sentSwap, err
+	}
+
+	noteUuid, err := noteLocation(userdata.Username, recipient, seq)
+	if err != nil {
+		return uuid.Nil, noteSwap, sentSwap, err
+	}
+	sig, err := userdata.sign(noteSigned(recipient, noteUuid, note_key_enc, note_enc))
+	if err != nil {
+		return uuid.Nil, noteSwap, sentSwap, err
+	}
+	note := appendField(appendField(appendField([]byte{inboxVersion}, note_key_enc), note_enc), sig)
+
+	rInboxUuid, err = inboxUuid(recipient)
+	if err != nil {
+		return uuid.Nil, noteSwap, sentSwap, err
+	}
+	noteSwap = journalSwap{Key: noteUuid, Old: nil, New: note}
+	sentSwap = journalSwap{Key: countUuid, Old: stored_sent, New: storable_sent}
+	return rInboxUuid, noteSwap, sentSwap, nil
+}
+
+// readInbox returns the note uuids listed in the inbox at rInboxUuid, and
+// the inbox as stored.
+func readInbox(rInboxUuid uuid.UUID) (noteUuids []uuid.UUID, stored_inbox []byte) {
+	stored_inbox, ok := store.Get(rInboxUuid)
+	if !ok {
+		return nil, nil
+	}
+	err := json.Unmarshal(stored_inbox, &noteUuids)
+	if err != nil {
+		// anyone can write to an inbox, so a broken one is replaced
+		noteUuids = nil
+	}
+	return noteUuids, stored_inbox
+}
+
+// appendNote returns the swap that adds noteUuid to the inbox at
+// rInboxUuid as it is now.
+func appendNote(rInboxUuid uuid.UUID, noteUuid uuid.UUID) (swap journalSwap, err error) {
+	noteUuids, stored_inbox := readInbox(rInboxUuid)
+
+	storable_inbox, err := json.Marshal(append(noteUuids, noteUuid))
+	if err != nil {
+		return swap, err
+	}
+	return journalSwap{Key: rInboxUuid, Old: stored_inbox, New: storable_inbox}, nil
+}
+
+// deliver adds noteUuid to the inbox at rInboxUuid, retrying when someone
+// else changes it in between.
+func deliver(rInboxUuid uuid.UUID, noteUuid uuid.UUID) (err error) {
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		swap, err := appendNote(rInboxUuid, noteUuid)
+		if err != nil {
+			return err
+		}
+
+		if store.CompareAndSwap(swap.Key, swap.Old, swap.New) {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+// resendNote leaves a note of the invitation at invitationPtr for
+// recipient after its first note lost its number to another session of the
+// user, moving the count on past every number found taken.
+func (userdata *User) resendNote(recipient string, rPublicKey userlib.PKEEncKey, invitationPtr uuid.UUID) (err error) {
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		rInboxUuid, noteSwap, sentSwap, err := userdata.newNote(recipient, rPublicKey, invitationPtr)
+		if err != nil {
+			return err
+		}
+
+		won := store.CompareAndSwap(noteSwap.Key, noteSwap.Old, noteSwap.New)
+		store.CompareAndSwap(sentSwap.Key, sentSwap.Old, sentSwap.New)
+		if won {
+			return deliver(rInboxUuid, noteSwap.Key)
+		}
+	}
+	return ErrConflict
+}
+
+// ListInvitations returns the invitations in the caller's inbox that can
+// still be accepted, oldest first. Notes of invitations that were accepted,
+// cancelled or have expired are removed. Entries that are not a note the
+// sender signed are dropped from the inbox, but what they point to is left
+// alone, since it need not be a note at all. Notes the caller has seen
+// before, or that come before the last one seen from their sender, are
+// looked up where they are stored when the inbox no longer lists them; each
+// one that is gone is reported as ErrNoteRemoved, once, along with the
+// invitations that are there.
+func (userdata *User) ListInvitations() (entries []InboxEntry, err error) {
+	inbox, err := inboxUuid(userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	noteUuids, stored_inbox := readInbox(inbox)
+	stored_notes := getMany(noteUuids)
+
+	var notes []inboxNote
+	kept := make([]uuid.UUID, 0, len(noteUuids))
+	var spent []uuid.UUID
+	found := make(map[string]map[int]bool)
+	see := func(noteUuid uuid.UUID, stored_note []byte) (genuine bool) {
+		note, entry, genuine, ok := userdata.readNote(noteUuid, stored_note)
+		if !genuine {
+			return false
+		}
+		if found[note.Sender] == nil {
+			found[note.Sender] = make(map[int]bool)
+		}
+		found[note.Sender][note.Seq] = true
+		if !ok {
+			spent = append(spent, noteUuid)
+			return true
+		}
+		notes = append(notes, note)
+		entries = append(entries, entry)
+		kept = append(kept, noteUuid)
+		return true
+	}
+	listed := make(map[uuid.UUID]bool)
+	for _, noteUuid := range noteUuids {
+		stored_note, ok := stored_notes[noteUuid]
+		if ok && !listed[noteUuid] {
+			see(noteUuid, stored_note)
+		}
+		listed[noteUuid] = true
+	}
+
+	book, _, err := userdata.getBook()
+	if err != nil {
+		return nil, err
+	}
+	seen := book.Seen
+
+	// the notes the inbox should list but doesn't
+	type expected struct {
+		sender string
+		seq    int
+	}
+	wanted := make(map[uuid.UUID]expected)
+	var wantedUuids []uuid.UUID
+	want := func(sender string, seq int) error {
+		if found[sender][seq] {
+			return nil
+		}
+		noteUuid, err := noteLocation(sender, userdata.Username, seq)
+		if err != nil {
+			return err
+		}
+		if _, ok := wanted[noteUuid]; !ok {
+			wanted[noteUuid] = expected{sender, seq}
+			wantedUuids = append(wantedUuids, noteUuid)
+		}
+		return nil
+	}
+	for sender, notes := range seen {
+		for _, seq := range notes.Pending {
+			err = want(sender, seq)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for sender, seqs := range found {
+		for seq := range seqs {
+			for earlier := seen[sender].Last + 1; earlier < seq; earlier++ {
+				err = want(sender, earlier)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var errs []error
+	stored_wanted := getMany(wantedUuids)
+	for _, noteUuid := range wantedUuids {
+		stored_note, ok := stored_wanted[noteUuid]
+		if !ok || !see(noteUuid, stored_note) {
+			missing := wanted[noteUuid]
+			errs = append(errs, fmt.Errorf("%s #%d: %w", missing.sender, missing.seq, ErrNoteRemoved))
+		}
+	}
+
+	// oldest first, whatever order the inbox lists them in
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return notes[order[i]].Sent < notes[order[j]].Sent
+	})
+	sorted := make([]InboxEntry, len(entries))
+	for i, at := range order {
+		sorted[i] = entries[at]
+	}
+	entries = sorted
+
+	if len(kept) != len(noteUuids) || len(wantedUuids) > 0 || noteUuids == nil && stored_inbox != nil {
+		storable_inbox, err := json.Marshal(kept)
+		if err != nil {
+			return nil, err
+		}
+
+		// a note delivered in between stays for the next call to find, and
+		// so do the spent notes
+		if store.CompareAndSwap(inbox, stored_inbox, storable_inbox) {
+			for _, noteUuid := range spent {
+				store.Delete(noteUuid)
+			}
+		}
+	}
+
+	// what is still pending is looked for next time, what is missing now
+	// is not reported again
+	pending := make(map[string][]int)
+	for _, note := range notes {
+		pending[note.Sender] = append(pending[note.Sender], note.Seq)
+	}
+	err = userdata.updateBook(func(book *inboxBook) bool {
+		changed := false
+		for sender := range found {
+			if _, ok := book.Seen[sender]; !ok {
+				book.Seen[sender] = seenNotes{}
+			}
+		}
+		for sender, notes := range book.Seen {
+			last := notes.Last
+			for seq := range found[sender] {
+				if seq > last {
+					last = seq
+				}
+			}
+			sort.Ints(pending[sender])
+			if last != notes.Last || !sameSeqs(notes.Pending, pending[sender]) {
+				book.Seen[sender] = seenNotes{last, pending[sender]}
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, errors.Join(errs...)
+}
+
+// readNote opens the note at noteUuid, reports whether its sender signed
+// it and it is stored where its number puts it, and whether the invitation
+// it points to can still be accepted.
+func (userdata *User) readNote(noteUuid uuid.UUID, stored_note []byte) (note inboxNote, entry InboxEntry, genuine bool, ok bool) {
+	if len(stored_note) == 0 || stored_note[0] != inboxVersion {
+		return note, entry, false, false
+	}
+	fields, _, err := splitFields(stored_note)
+	if err != nil || len(fields) != 3 {
+		return note, entry, false, false
+	}
+
+	err = hybridDec(userdata.decKeys(), fields[0], fields[1], &note)
+	if err != nil {
+		return note, entry, false, false
+	}
+
+	err = verifyBy(note.Sender, noteSigned(userdata.Username, noteUuid, fields[0], fields[1]), fields[2])
+	if err != nil {
+		return note, entry, false, false
+	}
+	at, err := noteLocation(note.Sender, userdata.Username, note.Seq)
+	if err != nil || at != noteUuid {
+		return note, entry, false, false
+	}
+
+	details, grant, err := userdata.inspectInvitation(note.Sender, note.InvitationPtr)
+	if err != nil || grant.inviteExpired() || grant.accessExpired() {
+		return note, entry, true, false
+	}
+	return note, InboxEntry{note.Sender, note.InvitationPtr, details}, true, true
+}
@@ -0,0 +1,215 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvitationCancelled = errors.New("invitation was cancelled by its sender")
+var ErrInvitationAccepted = errors.New("invitation was already accepted, revoke access instead")
+var ErrNoInvitation = errors.New("file was not shared with that user by you")
+var ErrInvitationExpired = errors.New("invitation has expired")
+
+// A cancelled invitation is replaced by a tombstone: the marker followed by
+// the sender's signature over the marker and invitationPtr. It stays in
+// place so the recipient learns why the invitation is gone.
+var cancelledMarker = []byte("cancelled")
+
+func tombstoneSigned(invitationPtr uuid.UUID) []byte {
+	return append(append([]byte{}, cancelledMarker...), invitationPtr[:]...)
+}
+
+func isTombstone(data []byte) bool {
+	return bytes.HasPrefix(data, cancelledMarker)
+}
+
+// checkTombstone returns ErrInvitationCancelled if the tombstone at
+// invitationPtr is signed by the sender.
+func checkTombstone(senderUsername string, invitationPtr uuid.UUID, data []byte) (err error) {
+	err = verifyBy(senderUsername, tombstoneSigned(invitationPtr), data[len(cancelledMarker):])
+	if err != nil {
+		return errors.New("DSVerify fail")
+	}
+	return ErrInvitationCancelled
+}
+
+// CancelInvitation withdraws an invitation to filename the caller made for
+// recipientUsername that has not been accepted yet. No keys are rotated:
+// the recipient never stored the NodeKey, and the UserFileNode it leads to
+// is deleted.
+func (userdata *User) CancelInvitation(filename string, recipientUsername string) (err error) {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	NodeKey, err := userdata.getNodeKey(filename)
+	if err != nil {
+		return err
+	}
+
+	sharedTo, err := GetSharedTo(NodeKey)
+	if err != nil {
+		return err
+	}
+
+	rNodeKey, ok := sharedTo[recipientUsername]
+	if !ok {
+		return ErrNoInvitation
+	}
+
+	grant, _, _, err := grantOf(rNodeKey, recipientUsername)
+	if err != nil {
+		return err
+	}
+	if grant.Grantor != userdata.Username {
+		return ErrNoInvitation
+	}
+
+	// acceptance is recorded with the marker, not by the invitation being
+	// gone
+	if inviteStatus(rNodeKey, grant) == StatusAccepted {
+		return ErrInvitationAccepted
+	}
+
+	// the tombstone goes in first, with a compare-and-swap, so an
+	// invitation accepted in the meantime is left alone. A group's
+	// invitation stays for the members, whose references to it lead to
+	// the deleted node.
+	stored_invitation, ok := store.Get(grant.Invitation)
+	if ok && !isTombstone(stored_invitation) {
+		sig, err := userdata.sign(tombstoneSigned(grant.Invitation))
+		if err != nil {
+			return err
+		}
+
+		tombstone := append(append([]byte{}, cancelledMarker...), sig...)
+		if !store.CompareAndSwap(grant.Invitation, stored_invitation, tombstone) {
+			return ErrInvitationAccepted
+		}
+	}
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+
+	err = dropSubtree(rNodeKey, &entry)
+	if err != nil {
+		return err
+	}
+	delete(sharedTo, recipientUsername)
+
+	sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
+	if err != nil {
+		return err
+	}
+
+	entry.Sets[sharedToUuid], err = MarshalAuthEnc(sharedTo, NodeKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = userdata.commit(entry)
+	return err
+}
+
+// CleanupInvitations removes every expired invitation below the caller in
+// the share tree of filename: the invitation blob, and the UserFileNode,
+// OwnerRecord, GrantChain and ShareMap made for it. It returns the
+// recipients whose invitations were removed. A sharee whose grants or
+// ShareMap can't be read is passed over with an error, and the rest are
+// still cleaned up.
+func (userdata *User) CleanupInvitations(filename string) (removed []string, err error) {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	NodeKey, err := userdata.getNodeKey(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := GetOwnerRecord(NodeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedTo, err := GetSharedTo(NodeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+
+	removed, errs, err := dropExpired(NodeKey, sharedTo, record, &entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(removed) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	_, err = userdata.commit(entry)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(removed)
+	return removed, errors.Join(errs...)
+}
+
+// dropExpired adds the removal of every expired invitation below sharedTo
+// (stored under NodeKey) to entry. errs has one error for every sharee
+// whose grants or ShareMap could not be read; err is for anything else.
+func dropExpired(NodeKey []byte, sharedTo ShareMap, record OwnerRecord, entry *journalEntry) (removed []string, errs []error, err error) {
+	cut := false
+	for username, uNodeKey := range sharedTo {
+		var grant Grant
+		chain, err := GetGrants(uNodeKey)
+		if err == nil {
+			grant, err = chain.verify(record)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", username, err))
+			continue
+		}
+
+		if inviteStatus(uNodeKey, grant) == StatusExpired {
+			err = dropSubtree(uNodeKey, entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			entry.Deletes = append(entry.Deletes, grant.Invitation)
+			delete(sharedTo, username)
+			removed = append(removed, username)
+			cut = true
+			continue
+		}
+
+		uSharedTo, err := GetSharedTo(uNodeKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", username, err))
+			continue
+		}
+
+		uRemoved, uErrs, err := dropExpired(uNodeKey, uSharedTo, record, entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		removed = append(removed, uRemoved...)
+		errs = append(errs, uErrs...)
+	}
+
+	if cut {
+		sharedToUuid, err := DeriveUuid(NodeKey, "ShareMap")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entry.Sets[sharedToUuid], err = MarshalAuthEnc(sharedTo, NodeKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return removed, errs, nil
+}
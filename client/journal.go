@@ -0,0 +1,320 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// journalEntry is one multi-write operation. It is written to the user's
+// journal before any of its writes reach the Datastore, so an operation cut
+// short by a crash can be finished by the next GetUser. Applying an entry
+// writes Sets, then performs Swaps, then removes Deletes; every step can be
+// repeated, so applying an entry twice is harmless. Prior holds what each
+// key in Sets held when the entry was journaled, nil for nothing.
+type journalEntry struct {
+	Sets    map[uuid.UUID][]byte
+	Prior   map[uuid.UUID][]byte
+	Swaps   []journalSwap
+	Deletes []uuid.UUID
+}
+
+// journalSwap is a compare-and-swap of Key from Old to New, where a nil Old
+// means Key must not exist. Undo lists the blobs in Sets that were written
+// only for this swap and are deleted again if it loses; Drop lists the
+// blobs it replaces, deleted only once it has won.
+type journalSwap struct {
+	Key  uuid.UUID
+	Old  []byte
+	New  []byte
+	Undo []uuid.UUID
+	Drop []uuid.UUID
+}
+
+// apply performs entry and returns the indexes of the swaps that lost. A
+// swap found already holding New won on an earlier attempt. When
+// recovering, a lost swap may also have won before the crash and been
+// overtaken since, so its Undo blobs are left alone; and when a later
+// operation has written over one of the Sets, the entry is rolled back
+// instead, unless it already got as far as its swaps.
+func (entry *journalEntry) apply(recovering bool) (lost []int) {
+	if recovering && entry.overtaken() {
+		if !entry.swapped() {
+			entry.rollBack()
+			for i := range entry.Swaps {
+				lost = append(lost, i)
+			}
+			return lost
+		}
+	} else {
+		setMany(entry.Sets)
+	}
+
+	for i, swap := range entry.Swaps {
+		won := store.CompareAndSwap(swap.Key, swap.Old, swap.New)
+		if !won {
+			current, ok := store.Get(swap.Key)
+			won = ok && bytes.Equal(current, swap.New)
+		}
+		if won {
+			for _, blobUuid := range swap.Drop {
+				store.Delete(blobUuid)
+			}
+			continue
+		}
+
+		lost = append(lost, i)
+		if !recovering {
+			for _, blobUuid := range swap.Undo {
+				store.Delete(blobUuid)
+			}
+		}
+	}
+
+	for _, blobUuid := range entry.Deletes {
+		store.Delete(blobUuid)
+	}
+	return lost
+}
+
+// prior records what the keys in Sets hold now.
+func (entry *journalEntry) prior() {
+	keys := make([]uuid.UUID, 0, len(entry.Sets))
+	for key := range entry.Sets {
+		keys = append(keys, key)
+	}
+	stored := getMany(keys)
+
+	entry.Prior = make(map[uuid.UUID][]byte)
+	for _, key := range keys {
+		entry.Prior[key] = stored[key]
+	}
+}
+
+// current returns what the keys in Sets hold now.
+func (entry *journalEntry) current() (stored map[uuid.UUID][]byte) {
+	keys := make([]uuid.UUID, 0, len(entry.Sets))
+	for key := range entry.Sets {
+		keys = append(keys, key)
+	}
+	return getMany(keys)
+}
+
+// overtaken reports whether a key in Sets holds neither what it held when
+// the entry was journaled nor what the entry writes there. Entries from
+// before Prior was recorded can't tell, and are never overtaken.
+func (entry *journalEntry) overtaken() bool {
+	if entry.Prior == nil {
+		return false
+	}
+
+	current := entry.current()
+	for key, value := range entry.Sets {
+		stored, ok := current[key]
+		if ok && bytes.Equal(stored, value) {
+			continue
+		}
+		prior := entry.Prior[key]
+		if ok == (prior != nil) && bytes.Equal(stored, prior) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// swapped reports whether any swap of the entry holds New, in which case
+// all of Sets were written before it.
+func (entry *journalEntry) swapped() bool {
+	for _, swap := range entry.Swaps {
+		current, ok := store.Get(swap.Key)
+		if ok && bytes.Equal(current, swap.New) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollBack puts back what the entry's Sets wrote over, where nothing was
+// written over them since.
+func (entry *journalEntry) rollBack() {
+	current := entry.current()
+	for key, value := range entry.Sets {
+		stored, ok := current[key]
+		if !ok || !bytes.Equal(stored, value) {
+			continue
+		}
+		prior := entry.Prior[key]
+		if prior == nil {
+			store.Delete(key)
+		} else {
+			store.CompareAndSwap(key, stored, prior)
+		}
+	}
+}
+
+// journal returns the key the user's journal is encrypted with and the
+// location of its index, the list of entries still in progress.
+func (userdata *User) journal() (journalKey []byte, indexUuid uuid.UUID, err error) {
+	return journalKeys(userdata.FilenameKey)
+}
+
+// journalKeys returns the journal key and index location that belong to
+// filenameKey.
+func journalKeys(filenameKey []byte) (journalKey []byte, indexUuid uuid.UUID, err error) {
+	journalKey, err = userlib.HashKDF(filenameKey, []byte("Journal"))
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	journalKey = journalKey[:16]
+
+	indexUuid, err = DeriveUuid(journalKey, "JournalIndex")
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	return journalKey, indexUuid, nil
+}
+
+// journalSlot is an entry in the journal index. The session that made the
+// entry holds a lease on it until Expires; until then no other session
+// replays it, because the operation may still be running. Expires is in
+// Unix nanoseconds, so every slot has the same size.
+type journalSlot struct {
+	Entry   uuid.UUID
+	Session uuid.UUID
+	Expires int64
+}
+
+// journalLease is how long an operation may take from journaling its entry
+// to retiring it. An entry still there after that was left by a crash.
+const journalLease = time.Minute
+
+// ErrJournalBusy is returned when the journal holds entries of operations
+// that may still be running.
+var ErrJournalBusy = errors.New("operations of another session are still in progress")
+
+// commit journals entry, applies it and retires it again.
+func (userdata *User) commit(entry journalEntry) (lost []int, err error) {
+	journalKey, indexUuid, err := userdata.journal()
+	if err != nil {
+		return nil, err
+	}
+
+	entry.prior()
+	entryUuid := uuid.New()
+	storable_entry, err := MarshalAuthEnc(entry, journalKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the index learns about the entry first, so no entry blob is ever
+	// unreachable; an index slot whose entry never got written is dropped
+	// on recovery once its lease is up
+	slot := journalSlot{Entry: entryUuid, Session: userdata.session, Expires: now().Add(journalLease).UnixNano()}
+	err = updateJournalIndex(journalKey, indexUuid, func(slots []journalSlot) []journalSlot {
+		return append(slots, slot)
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.Set(entryUuid, storable_entry)
+
+	lost = entry.apply(false)
+
+	store.Delete(entryUuid)
+	// the operation is done whether or not this succeeds, a stale slot is
+	// dropped on recovery
+	updateJournalIndex(journalKey, indexUuid, func(slots []journalSlot) []journalSlot {
+		return removeSlot(slots, entryUuid)
+	})
+
+	return lost, nil
+}
+
+// recoverJournal finishes every operation a crashed session left in the
+// journal. It runs in GetUser. Entries of this session and entries whose
+// lease is not up yet belong to operations that may still be running, and
+// are left alone; pending reports whether there were any.
+func (userdata *User) recoverJournal() (pending bool, err error) {
+	journalKey, indexUuid, err := userdata.journal()
+	if err != nil {
+		return false, err
+	}
+
+	stored_index, ok := store.Get(indexUuid)
+	if !ok {
+		return false, nil
+	}
+
+	var slots []journalSlot
+	err = UnmarshalAuthDec(journalKey, stored_index, &slots)
+	if err != nil {
+		return false, err
+	}
+
+	for _, slot := range slots {
+		if slot.Session == userdata.session || now().UnixNano() < slot.Expires {
+			pending = true
+			continue
+		}
+
+		stored_entry, ok := store.Get(slot.Entry)
+		if ok {
+			var entry journalEntry
+			err = UnmarshalAuthDec(journalKey, stored_entry, &entry)
+			if err != nil {
+				return pending, err
+			}
+
+			entry.apply(true)
+			store.Delete(slot.Entry)
+		}
+
+		err = updateJournalIndex(journalKey, indexUuid, func(slots []journalSlot) []journalSlot {
+			return removeSlot(slots, slot.Entry)
+		})
+		if err != nil {
+			return pending, err
+		}
+	}
+	return pending, nil
+}
+
+// updateJournalIndex rewrites the journal index with update, retrying when
+// another session of the user changes it in between.
+func updateJournalIndex(journalKey []byte, indexUuid uuid.UUID, update func(slots []journalSlot) []journalSlot) (err error) {
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		var slots []journalSlot
+
+		stored_index, ok := store.Get(indexUuid)
+		if ok {
+			err = UnmarshalAuthDec(journalKey, stored_index, &slots)
+			if err != nil {
+				return err
+			}
+		}
+
+		storable_index, err := MarshalAuthEnc(update(slots), journalKey)
+		if err != nil {
+			return err
+		}
+
+		if store.CompareAndSwap(indexUuid, stored_index, storable_index) {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+func removeSlot(slots []journalSlot, entryUuid uuid.UUID) []journalSlot {
+	kept := make([]journalSlot, 0, len(slots))
+	for _, slot := range slots {
+		if slot.Entry != entryUuid {
+			kept = append(kept, slot)
+		}
+	}
+	return kept
+}
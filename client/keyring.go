@@ -0,0 +1,117 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// KeyRing lists the FileKeys a file had before its current one, newest
+// first. RevokeAccess only rotates the FileKey; chunks written under an
+// older key are re-encrypted under the current one the next time they are
+// read, and until then the ring (stored under the current key) is how
+// readers decrypt them.
+type KeyRing [][]byte
+
+// GetKeyRing returns the ring kept under fileKey, which is empty if every
+// chunk of the file is already encrypted under fileKey.
+func GetKeyRing(fileKey []byte) (ring KeyRing, err error) {
+
+	ringUuid, err := DeriveUuid(fileKey, "KeyRing")
+	if err != nil {
+		return nil, err
+	}
+
+	stored_ring, ok := store.Get(ringUuid)
+	if !ok {
+		return nil, nil
+	}
+
+	err = UnmarshalAuthDec(fileKey, stored_ring, &ring)
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// chainWalk follows one file's chain backwards from its pointer.
+type chainWalk struct {
+	fileKey     []byte
+	ring        KeyRing
+	ringFetched bool
+	next        ChunkPointer
+	pieces      [][]byte
+	cached      bool
+
+	// the Base the chain must pass through, and whether it has
+	base    ChunkPointer
+	reached bool
+}
+
+func newChainWalk(fileKey []byte, pointer ChunkPointer) *chainWalk {
+	base := ChunkPointer{Chunk: pointer.Base, Hash: pointer.BaseHash}
+	return &chainWalk{fileKey: fileKey, next: pointer, base: base, reached: base.Chunk == uuid.Nil}
+}
+
+func (walk *chainWalk) done() bool {
+	return walk.next.Chunk == uuid.Nil
+}
+
+func (walk *chainWalk) add(chunk FileChunk) {
+	if walk.next.Chunk == walk.base.Chunk && bytes.Equal(walk.next.Hash, walk.base.Hash) {
+		walk.reached = true
+	}
+	walk.pieces = append(walk.pieces, chunk.Content)
+	walk.next = ChunkPointer{Chunk: chunk.Prev, Hash: chunk.PrevHash}
+}
+
+// open decrypts the next chunk of the walk and checks it against the hash
+// its successor recorded. A chunk still under an old key is returned with
+// its re-encryption under the current key in reencrypted.
+func (walk *chainWalk) open(stored_chunk []byte) (chunk FileChunk, reencrypted []byte, err error) {
+
+	chunkBytes, err := AuthDec(walk.fileKey, stored_chunk)
+	underOldKey := err != nil
+	if underOldKey {
+		if !walk.ringFetched {
+			walk.ring, err = GetKeyRing(walk.fileKey)
+			if err != nil {
+				return chunk, nil, err
+			}
+			walk.ringFetched = true
+		}
+
+		err = errors.New("chunk not encrypted under any key of the file")
+		for _, oldKey := range walk.ring {
+			chunkBytes, err = AuthDec(oldKey, stored_chunk)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return chunk, nil, err
+		}
+	}
+
+	// checked before re-encrypting, or a chunk forged by someone holding an
+	// old key would be laundered under the current one
+	if !bytes.Equal(userlib.Hash(chunkBytes), walk.next.Hash) {
+		return chunk, nil, errors.New("chunk does not match the hash recorded for it")
+	}
+
+	err = json.Unmarshal(chunkBytes, &chunk)
+	if err != nil {
+		return chunk, nil, err
+	}
+
+	if underOldKey {
+		reencrypted, err = AuthEnc(walk.fileKey, chunkBytes)
+		if err != nil {
+			return chunk, nil, err
+		}
+	}
+	return chunk, reencrypted, nil
+}
@@ -0,0 +1,436 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A user's public keys are published in the Keystore under versioned
+// names. The pair made by InitUser is version 1, under username+"_Public"
+// and username+"_Verify"; every pair RotateKeys makes after it gets "_v2",
+// "_v3" and so on appended. Keystore entries can't be replaced, so every
+// version stays published.
+func keystoreName(username string, kind string, version int) string {
+	if version <= 1 {
+		return username + "_" + kind
+	}
+	return fmt.Sprintf("%s_%s_v%d", username, kind, version)
+}
+
+var ErrStaleSession = errors.New("the user was changed by another session, log in again")
+var ErrKeyReplaced = errors.New("signed with a key that had been replaced")
+var ErrKeysUnverifiable = errors.New("the newest keys published for the user have no record of their rotation")
+var ErrTransferPending = errors.New("an ownership transfer of the user is still pending")
+
+// Anyone can publish under any Keystore name, so a version after the first
+// only counts when the Datastore holds a keyRecord for it, signed with the
+// version before it, Prev. The versions in between were published by
+// someone else.
+type keyRecord struct {
+	Version   int
+	Prev      int
+	PublicKey userlib.PKEEncKey
+	VerifyKey userlib.DSVerifyKey
+	Sig       []byte
+}
+
+// keyVersion is a version of a user's keys that is in use.
+type keyVersion struct {
+	Version   int
+	PublicKey userlib.PKEEncKey
+	VerifyKey userlib.DSVerifyKey
+}
+
+// pendingKeys are the key pairs RotateKeys is publishing.
+type pendingKeys struct {
+	Version   int
+	PublicKey userlib.PKEEncKey
+	DecKey    userlib.PKEDecKey
+	VerifyKey userlib.DSVerifyKey
+	SignKey   userlib.DSSignKey
+}
+
+func keyRecordUuid(username string, version int) (uuid.UUID, error) {
+	return DeriveUuid(userlib.Hash([]byte(username))[:16], fmt.Sprintf("Keys v%d", version))
+}
+
+func (record keyRecord) signed() ([]byte, error) {
+	record.Sig = nil
+	return json.Marshal(record)
+}
+
+func sameKey(a userlib.PublicKeyType, b userlib.PublicKeyType) bool {
+	return a.KeyType == b.KeyType && a.PubKey.Equal(&b.PubKey)
+}
+
+// getKeyRecord retrieves username's record of version, if it was made for
+// the keys published under it.
+func getKeyRecord(username string, version int, publicKey userlib.PKEEncKey, verifyKey userlib.DSVerifyKey) (record keyRecord, ok bool) {
+	recordUuid, err := keyRecordUuid(username, version)
+	if err != nil {
+		return record, false
+	}
+
+	stored_record, ok := store.Get(recordUuid)
+	if !ok {
+		return record, false
+	}
+
+	err = json.Unmarshal(stored_record, &record)
+	if err != nil || record.Version != version {
+		return record, false
+	}
+	return record, sameKey(record.PublicKey, publicKey) && sameKey(record.VerifyKey, verifyKey)
+}
+
+// keyChain returns the versions of username's keys, oldest first, and
+// whether the newest of them is the newest version published. Versions
+// without a record signed with the one before are skipped. Keystore names
+// can't be deleted while records can, so a newest version without a
+// record may be a rotation whose record was deleted: the chain is broken,
+// and no signature of the user verifies, until they rotate past it.
+func keyChain(username string) (chain []keyVersion, ok bool) {
+	publicKey, ok := KeystoreGet(keystoreName(username, "Public", 1))
+	if !ok {
+		return nil, false
+	}
+	verifyKey, ok := KeystoreGet(keystoreName(username, "Verify", 1))
+	if !ok {
+		return nil, false
+	}
+	chain = []keyVersion{{1, publicKey, verifyKey}}
+
+	newest := 1
+	for version := 2; ; version++ {
+		verifyKey, found := KeystoreGet(keystoreName(username, "Verify", version))
+		if !found {
+			break
+		}
+		newest = version
+		publicKey, found := KeystoreGet(keystoreName(username, "Public", version))
+		if !found {
+			continue
+		}
+
+		record, found := getKeyRecord(username, version, publicKey, verifyKey)
+		last := chain[len(chain)-1]
+		if !found || record.Prev != last.Version {
+			continue
+		}
+		signed, err := record.signed()
+		if err != nil || userlib.DSVerify(last.VerifyKey, signed, record.Sig) != nil {
+			continue
+		}
+		chain = append(chain, keyVersion{version, publicKey, verifyKey})
+	}
+	return chain, chain[len(chain)-1].Version == newest
+}
+
+// publicKeyOf returns username's newest public encryption key.
+func publicKeyOf(username string) (publicKey userlib.PKEEncKey, ok bool) {
+	chain, ok := keyChain(username)
+	if !ok {
+		return publicKey, false
+	}
+	return chain[len(chain)-1].PublicKey, true
+}
+
+// A signature is a version byte followed by fields: the version of the
+// signer's keys it was made with, and the signature itself over the version
+// and the data.
+const sigVersion = 3
+
+func sigSigned(version int, data []byte) []byte {
+	context := fmt.Sprintf("signed %d ", version)
+	return append([]byte(context), data...)
+}
+
+func splitSig(sig []byte) (version int, rsaSig []byte, err error) {
+	if len(sig) == 0 || sig[0] != sigVersion {
+		return 0, nil, errors.New("signature format")
+	}
+	fields, _, err := splitFields(sig)
+	if err != nil || len(fields) != 2 {
+		return 0, nil, errors.New("signature format")
+	}
+	version, err = strconv.Atoi(string(fields[0]))
+	if err != nil {
+		return 0, nil, errors.New("signature format")
+	}
+	return version, fields[1], nil
+}
+
+// signKey returns the version of the caller's keys and their signing key,
+// as they are while no rotation is swapping them.
+func (userdata *User) signKey() (version int, signKey userlib.DSSignKey) {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+	return userdata.KeyVersion, userdata.SignKey
+}
+
+// sign signs data with the caller's keys, which must be the newest ones
+// they have published.
+func (userdata *User) sign(data []byte) (sig []byte, err error) {
+	version, signKey := userdata.signKey()
+	chain, ok := keyChain(userdata.Username)
+	if !ok || chain[len(chain)-1].Version != version {
+		return nil, ErrStaleSession
+	}
+
+	rsaSig, err := userlib.DSSign(signKey, sigSigned(version, data))
+	if err != nil {
+		return nil, err
+	}
+
+	sig = appendField([]byte{sigVersion}, []byte(strconv.Itoa(version)))
+	return appendField(sig, rsaSig), nil
+}
+
+// verifyBy checks that username signed data with sig, using the newest
+// version of their keys. A rotation signs again what the user signed with
+// the older ones, so what an older version signs is rejected, whenever it
+// claims to have been signed.
+func verifyBy(username string, data []byte, sig []byte) (err error) {
+	version, rsaSig, err := splitSig(sig)
+	if err != nil {
+		return err
+	}
+
+	chain, ok := keyChain(username)
+	if chain == nil {
+		return errors.New(username + " doesnt exist")
+	}
+	if !ok {
+		return ErrKeysUnverifiable
+	}
+
+	keys := chain[len(chain)-1]
+	if version < keys.Version {
+		return ErrKeyReplaced
+	}
+	if version != keys.Version {
+		return errors.New("no such key version")
+	}
+	return userlib.DSVerify(keys.VerifyKey, sigSigned(version, data), rsaSig)
+}
+
+// signedBefore reports whether sig is the caller's own signature over data,
+// made with a version of their keys in chain before the one they sign with
+// now.
+func (userdata *User) signedBefore(chain []keyVersion, data []byte, sig []byte) bool {
+	version, rsaSig, err := splitSig(sig)
+	if err != nil {
+		return false
+	}
+	current, _ := userdata.signKey()
+	if version >= current {
+		return false
+	}
+
+	for _, keys := range chain {
+		if keys.Version == version {
+			return userlib.DSVerify(keys.VerifyKey, sigSigned(version, data), rsaSig) == nil
+		}
+	}
+	return false
+}
+
+// decKeys returns the user's private keys, newest first. Invitations and
+// group keys sealed before a rotation are still sealed to the older ones,
+// and during one, to the keys being published.
+func (userdata *User) decKeys() []userlib.PKEDecKey {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+
+	decKeys := append([]userlib.PKEDecKey{userdata.DecKey}, userdata.OldDecKeys...)
+	if userdata.NextKeys != nil {
+		decKeys = append([]userlib.PKEDecKey{userdata.NextKeys.DecKey}, decKeys...)
+	}
+	return decKeys
+}
+
+// RotateKeys gives the user new key pairs. They are stored in the User
+// struct first, then published under the next free version, recorded, and
+// made the user's keys, keeping the old decryption keys for what was
+// sealed to them. Last, everything of the user's that is signed with the
+// old keys is signed again with the new ones. A crash anywhere leaves a
+// rotation the next GetUser finishes. Other sessions of the user can't
+// sign, or store the user, until they log in again. It fails with
+// ErrUnindexedFiles while the namespace may have files the index misses,
+// and with ErrTransferPending while a file the user handed over has not
+// been accepted yet.
+func (userdata *User) RotateKeys() (err error) {
+	err = userdata.finishKeyRotation()
+	if err != nil {
+		return err
+	}
+	if !userdata.Indexed {
+		return ErrUnindexedFiles
+	}
+
+	pending, err := userdata.transferPending()
+	if err != nil {
+		return err
+	}
+	if pending {
+		return ErrTransferPending
+	}
+
+	version, _ := userdata.signKey()
+	next := pendingKeys{Version: version + 1}
+
+	next.PublicKey, next.DecKey, err = userlib.PKEKeyGen()
+	if err != nil {
+		return err
+	}
+
+	next.SignKey, next.VerifyKey, err = userlib.DSKeyGen()
+	if err != nil {
+		return err
+	}
+
+	// with the private keys stored first, nothing is ever published that
+	// the user can't use
+	userdata.mu.Lock()
+	userdata.NextKeys = &next
+	userdata.mu.Unlock()
+	err = userdata.storeUser()
+	if err != nil {
+		userdata.mu.Lock()
+		userdata.NextKeys = nil
+		userdata.mu.Unlock()
+		return err
+	}
+
+	return userdata.finishKeyRotation()
+}
+
+// finishKeyRotation carries on with a rotation from wherever it stands:
+// with NextKeys, they are published, recorded and swapped in; with Resign,
+// what the old keys signed is signed again. Each step can be repeated.
+func (userdata *User) finishKeyRotation() (err error) {
+	userdata.mu.Lock()
+	pending, resign := userdata.NextKeys, userdata.Resign
+	userdata.mu.Unlock()
+
+	if pending != nil {
+		err = userdata.swapKeys(*pending)
+		if err != nil {
+			return err
+		}
+		resign = true
+	}
+
+	if resign {
+		err = userdata.signAgain()
+		if err != nil {
+			return err
+		}
+
+		userdata.mu.Lock()
+		userdata.Resign = false
+		userdata.mu.Unlock()
+		return userdata.storeUser()
+	}
+	return nil
+}
+
+// swapKeys publishes and records next, and makes them the user's keys. The
+// keys are only swapped under the session's lock, so operations running
+// alongside sign with one version or the other.
+func (userdata *User) swapKeys(next pendingKeys) (err error) {
+	version, signKey := userdata.signKey()
+
+	// a version someone else published under is skipped
+	for attempt := 0; !publishKeys(userdata.Username, &next); attempt++ {
+		if attempt == maxRetries {
+			return ErrConflict
+		}
+		next.Version++
+	}
+
+	_, ok := getKeyRecord(userdata.Username, next.Version, next.PublicKey, next.VerifyKey)
+	if !ok {
+		record := keyRecord{
+			Version:   next.Version,
+			Prev:      version,
+			PublicKey: next.PublicKey,
+			VerifyKey: next.VerifyKey,
+		}
+
+		signed, err := record.signed()
+		if err != nil {
+			return err
+		}
+		record.Sig, err = userlib.DSSign(signKey, signed)
+		if err != nil {
+			return err
+		}
+
+		recordUuid, err := keyRecordUuid(userdata.Username, next.Version)
+		if err != nil {
+			return err
+		}
+		storable_record, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		store.Set(recordUuid, storable_record)
+	}
+
+	userdata.mu.Lock()
+	userdata.OldDecKeys = append([]userlib.PKEDecKey{userdata.DecKey}, userdata.OldDecKeys...)
+	userdata.DecKey = next.DecKey
+	userdata.SignKey = next.SignKey
+	userdata.KeyVersion = next.Version
+	userdata.NextKeys = nil
+	userdata.Resign = true
+	userdata.mu.Unlock()
+
+	return userdata.storeUser()
+}
+
+// publishKeys publishes next's public keys under its version, and reports
+// whether they are there now. They are not if someone else took the
+// version.
+func publishKeys(username string, next *pendingKeys) bool {
+	return publishKey(keystoreName(username, "Verify", next.Version), next.VerifyKey) &&
+		publishKey(keystoreName(username, "Public", next.Version), next.PublicKey)
+}
+
+func publishKey(name string, key userlib.PublicKeyType) bool {
+	if KeystoreSet(name, key) == nil {
+		return true
+	}
+	published, ok := KeystoreGet(name)
+	return ok && sameKey(published, key)
+}
+
+// storeUser stores the User struct again, under the key derived from the
+// password at login. It is a compare-and-swap against the struct as this
+// session last read or stored it, so a session never overwrites what
+// another one stored since, such as new keys.
+func (userdata *User) storeUser() (err error) {
+	userUuid, err := DeriveUuid(userdata.userKey, "UUID")
+	if err != nil {
+		return err
+	}
+
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+	storable_user, err := MarshalAuthEnc(userdata, userdata.userKey)
+	if err != nil {
+		return err
+	}
+
+	if !store.CompareAndSwap(userUuid, userdata.storedUser, storable_user) {
+		return ErrStaleSession
+	}
+	userdata.storedUser = storable_user
+	return nil
+}
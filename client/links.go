@@ -0,0 +1,152 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A share link is a read-only sharee with no account: a UserFileNode in the
+// share tree like any other, whose NodeKey is handed out as the token. It
+// appears in its sharer's ShareMap, and in ListSharees, under a name
+// derived from the token, so it is revoked like any other sharee, keys
+// rotated and all.
+const linkPrefix = "link:"
+
+var ErrInvalidLink = errors.New("invalid share link")
+
+func isLink(recipient string) bool {
+	return strings.HasPrefix(recipient, linkPrefix)
+}
+
+// linkName is the sharee name of the link with NodeKey.
+func linkName(NodeKey []byte) string {
+	return linkPrefix + hex.EncodeToString(userlib.Hash(NodeKey)[:8])
+}
+
+func parseLink(token string) (NodeKey []byte, err error) {
+	NodeKey, err = hex.DecodeString(token)
+	if err != nil || len(NodeKey) != 16 {
+		return nil, ErrInvalidLink
+	}
+	return NodeKey, nil
+}
+
+// CreateShareLink returns a token anyone can read filename with, using
+// LoadFromLink, until it is revoked with RevokeShareLink. Only users who
+// may reshare the file can create links.
+func (userdata *User) CreateShareLink(filename string) (token string, err error) {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := userdata.openFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	sGrant, sChain, record, err := grantOf(file.NodeKey, userdata.Username)
+	if err != nil {
+		return "", err
+	}
+
+	NodeKey := userlib.RandomBytes(16)
+	name := linkName(NodeKey)
+
+	grant, err := userdata.newGrant(sGrant, record.FileID, name, uuid.Nil,
+		inviteOptions{perms: PermRead, depth: 0, depthSet: true})
+	if err != nil {
+		return "", err
+	}
+
+	node := UserFileNode{
+		LastChunkUuid: file.Node.LastChunkUuid,
+		FileKey:       file.Node.FileKey,
+		Perms:         grant.Perms,
+		VerifyKey:     file.Node.VerifyKey,
+
+		AppendVerifyKey: file.Node.AppendVerifyKey,
+	}
+
+	sharedTo, err := GetSharedTo(file.NodeKey)
+	if err != nil {
+		return "", err
+	}
+	sharedTo[name] = NodeKey
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+
+	blobs := []struct {
+		NodeKey []byte
+		purpose string
+		data    any
+	}{
+		{NodeKey, "UserFileNode", node},
+		{NodeKey, "OwnerRecord", record},
+		{NodeKey, "Grants", append(append(GrantChain{}, sChain...), grant)},
+		{NodeKey, "ShareMap", make(ShareMap)},
+		{file.NodeKey, "ShareMap", sharedTo},
+	}
+	for _, blob := range blobs {
+		blobUuid, err := DeriveUuid(blob.NodeKey, blob.purpose)
+		if err != nil {
+			return "", err
+		}
+
+		entry.Sets[blobUuid], err = MarshalAuthEnc(blob.data, blob.NodeKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !grant.Until.IsZero() {
+		err = userdata.schedule(filename)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	_, err = userdata.commit(entry)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(NodeKey), nil
+}
+
+// LoadFromLink reads the file a share link was made for. It needs no
+// account, only the token.
+func LoadFromLink(token string) (content []byte, err error) {
+	NodeKey, err := parseLink(token)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := GetNode(NodeKey)
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+
+	lastChunk, stored_lastChunk, err := GetLastChunk(node)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, errs := loadChains(map[string]openedFile{"": {NodeKey, node, lastChunk, stored_lastChunk}}, nil)
+	if errs[""] != nil {
+		return nil, errs[""]
+	}
+	return contents[""], nil
+}
+
+// RevokeShareLink revokes a share link to filename made by the caller or
+// anyone below them in the share tree, with RevokeAccess.
+func (userdata *User) RevokeShareLink(filename string, token string) (err error) {
+	NodeKey, err := parseLink(token)
+	if err != nil {
+		return err
+	}
+	return userdata.RevokeAccess(filename, linkName(NodeKey))
+}
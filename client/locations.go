@@ -0,0 +1,378 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+var ErrFixedLocations = errors.New("NodeKeys are at fixed locations, call EnableRandomNodeKeyLocations first")
+
+// By default the NodeKey of a filename is stored at a location derived from
+// the FilenameKey and the filename, so every access to the same filename
+// touches the same uuid. With random locations the index is the only way to
+// a NodeKey: it is stored at a random location, and a filename that is not
+// in the namespace is looked up at a random location that only ever misses.
+// Only the NodeKeys move; the other blobs of a file stay where they are.
+
+// randomNodeKeys reports whether the caller's NodeKeys are at random
+// locations.
+func (userdata *User) randomNodeKeys() bool {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+	return userdata.RandomNodeKeys
+}
+
+// EnableRandomNodeKeyLocations moves every NodeKey in the caller's namespace to a
+// random location. It cannot be turned off again, and other sessions must
+// log in again afterwards.
+func (userdata *User) EnableRandomNodeKeyLocations() (err error) {
+	if userdata.randomNodeKeys() {
+		return nil
+	}
+	if !userdata.Indexed {
+		return ErrUnindexedFiles
+	}
+
+	// with the flag stored first, a NodeKey is found through the index
+	// whether or not it was moved yet
+	userdata.mu.Lock()
+	userdata.RandomNodeKeys = true
+	userdata.mu.Unlock()
+	err = userdata.storeUser()
+	if err != nil {
+		userdata.mu.Lock()
+		userdata.RandomNodeKeys = false
+		userdata.mu.Unlock()
+		return err
+	}
+
+	return userdata.MoveNodeKeys()
+}
+
+// MoveNodeKeys moves every NodeKey in the caller's namespace to a new random
+// location. Other sessions must log in again afterwards.
+func (userdata *User) MoveNodeKeys() (err error) {
+	if !userdata.randomNodeKeys() {
+		return ErrFixedLocations
+	}
+
+	indexKey, indexUuid, err := fileIndexKey(userdata.FilenameKey)
+	if err != nil {
+		return err
+	}
+
+	index, _, err := getIndex(indexKey, indexUuid)
+	if err != nil {
+		return err
+	}
+
+	filenames := make([]string, 0, len(index))
+	for filename := range index {
+		filenames = append(filenames, filename)
+	}
+	return userdata.relocate(filenames)
+}
+
+// A session reads the index once and keeps a copy of it, so that finding a
+// NodeKey costs the same however many files there are. The copy is only
+// read again for a filename it does not have, or whose NodeKey is not where
+// the copy says, which happens when another session deleted the file and
+// stored it again.
+
+// cachedSlots returns the location of the NodeKey of every filename, and
+// whether the index was read for them.
+func (userdata *User) cachedSlots(filenames []string) (slots map[string]uuid.UUID, fresh bool, err error) {
+	slots = make(map[string]uuid.UUID)
+
+	if !userdata.randomNodeKeys() {
+		for _, filename := range filenames {
+			slots[filename], err = DeriveUuid(userdata.FilenameKey, filename)
+			if err != nil {
+				return nil, true, err
+			}
+		}
+		return slots, true, nil
+	}
+
+	userdata.mu.Lock()
+	for _, filename := range filenames {
+		slot, ok := userdata.slots[filename]
+		if !ok {
+			break
+		}
+		slots[filename] = slot
+	}
+	userdata.mu.Unlock()
+	if len(slots) == len(filenames) {
+		return slots, false, nil
+	}
+
+	index, err := userdata.readSlots()
+	if err != nil {
+		return nil, true, err
+	}
+
+	for _, filename := range filenames {
+		slot, ok := index[filename]
+		if !ok {
+			slot = uuid.New()
+		}
+		slots[filename] = slot
+	}
+	return slots, true, nil
+}
+
+// readSlots reads the index into the session's copy.
+func (userdata *User) readSlots() (index map[string]uuid.UUID, err error) {
+	indexKey, indexUuid, err := fileIndexKey(userdata.FilenameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	index, _, err = getIndex(indexKey, indexUuid)
+	if err != nil {
+		return nil, err
+	}
+	userdata.setSlots(index)
+	return index, nil
+}
+
+func (userdata *User) setSlots(index map[string]uuid.UUID) {
+	slots := make(map[string]uuid.UUID, len(index))
+	for filename, slot := range index {
+		slots[filename] = slot
+	}
+
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+	userdata.slots = slots
+}
+
+// forgetSlots drops the session's copy of the index, for the next lookup
+// to read it again.
+func (userdata *User) forgetSlots() {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+	userdata.slots = nil
+}
+
+// updateSlots applies update to the session's copy of the index, if it has
+// one.
+func (userdata *User) updateSlots(update func(slots map[string]uuid.UUID)) {
+	userdata.mu.Lock()
+	defer userdata.mu.Unlock()
+	if userdata.slots != nil {
+		update(userdata.slots)
+	}
+}
+
+// slotUuids returns the location of the NodeKey of every filename.
+func (userdata *User) slotUuids(filenames []string) (slots map[string]uuid.UUID, err error) {
+	slots, _, err = userdata.cachedSlots(filenames)
+	return slots, err
+}
+
+// slotUuid is slotUuids for a single filename.
+func (userdata *User) slotUuid(filename string) (slot uuid.UUID, err error) {
+	slots, err := userdata.slotUuids([]string{filename})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return slots[filename], nil
+}
+
+// getSlots fetches the NodeKey of every filename, and returns where each
+// was looked up and what was found there.
+func (userdata *User) getSlots(filenames []string) (slots map[string]uuid.UUID, stored_NodeKeys map[uuid.UUID][]byte, err error) {
+	slots, fresh, err := userdata.cachedSlots(filenames)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]uuid.UUID, 0, len(slots))
+	for _, slot := range slots {
+		keys = append(keys, slot)
+	}
+	stored_NodeKeys = getMany(keys)
+
+	var missed []string
+	for filename, slot := range slots {
+		if _, ok := stored_NodeKeys[slot]; !ok {
+			missed = append(missed, filename)
+		}
+	}
+	if fresh || len(missed) == 0 {
+		return slots, stored_NodeKeys, nil
+	}
+
+	index, err := userdata.readSlots()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys = keys[:0]
+	for _, filename := range missed {
+		slot, ok := index[filename]
+		if ok && slot != slots[filename] {
+			slots[filename] = slot
+			keys = append(keys, slot)
+		}
+	}
+	for slot, stored_NodeKey := range getMany(keys) {
+		stored_NodeKeys[slot] = stored_NodeKey
+	}
+	return slots, stored_NodeKeys, nil
+}
+
+// getSlot is getSlots for a single filename.
+func (userdata *User) getSlot(filename string) (slot uuid.UUID, stored_NodeKey []byte, ok bool, err error) {
+	slots, stored_NodeKeys, err := userdata.getSlots([]string{filename})
+	if err != nil {
+		return uuid.Nil, nil, false, err
+	}
+	slot = slots[filename]
+	stored_NodeKey, ok = stored_NodeKeys[slot]
+	return slot, stored_NodeKey, ok, nil
+}
+
+// reserveSlot returns the location a NodeKey for filename is to be stored
+// at. With random locations a filename that is not in the index yet is
+// given a random one there, so two sessions storing the same new filename
+// race for the same location like they do by default.
+func (userdata *User) reserveSlot(filename string) (slot uuid.UUID, err error) {
+	if !userdata.randomNodeKeys() {
+		return DeriveUuid(userdata.FilenameKey, filename)
+	}
+
+	err = userdata.updateIndex(func(index map[string]uuid.UUID) {
+		reserved, ok := index[filename]
+		if !ok {
+			reserved = uuid.New()
+			index[filename] = reserved
+		}
+		slot = reserved
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	userdata.updateSlots(func(slots map[string]uuid.UUID) {
+		slots[filename] = slot
+	})
+	return slot, nil
+}
+
+// checkFree fails if filename is in the namespace, without reserving a
+// location for it.
+func (userdata *User) checkFree(filename string) (err error) {
+	_, _, ok, err := userdata.getSlot(filename)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errors.New(filename + "already in namespace")
+	}
+	return nil
+}
+
+// freeSlot is reserveSlot for a filename that must not be in the
+// namespace. Accepting calls it only once the invitation checked out, so
+// a rejected one leaves nothing in the index.
+func (userdata *User) freeSlot(filename string) (slot uuid.UUID, err error) {
+	slot, err = userdata.reserveSlot(filename)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	_, ok := store.Get(slot)
+	if ok {
+		return uuid.Nil, errors.New(filename + "already in namespace")
+	}
+	return slot, nil
+}
+
+// newSlot returns where the NodeKey of filename goes under filenameKey.
+func (userdata *User) newSlot(filenameKey []byte, filename string) (slot uuid.UUID, err error) {
+	if userdata.randomNodeKeys() {
+		return uuid.New(), nil
+	}
+	return DeriveUuid(filenameKey, filename)
+}
+
+// relocate moves the NodeKeys of filenames to new random locations, in one
+// swap of the index; the old locations are deleted once it won.
+func (userdata *User) relocate(filenames []string) (err error) {
+	if len(filenames) == 0 {
+		return nil
+	}
+
+	indexKey, indexUuid, err := fileIndexKey(userdata.FilenameKey)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		index, stored_index, err := getIndex(indexKey, indexUuid)
+		if err != nil {
+			return err
+		}
+
+		var oldSlots []uuid.UUID
+		for _, filename := range filenames {
+			slot, ok := index[filename]
+			if ok {
+				oldSlots = append(oldSlots, slot)
+			}
+		}
+		stored_NodeKeys := getMany(oldSlots)
+
+		sets := make(map[uuid.UUID][]byte)
+		var newSlots, dropped []uuid.UUID
+		for _, filename := range filenames {
+			slot := index[filename]
+			stored_NodeKey, ok := stored_NodeKeys[slot]
+			if !ok {
+				continue
+			}
+
+			// encrypted afresh, so the moved blob cannot be matched with
+			// the old one either
+			NodeKey, err := AuthDec(userdata.FilenameKey, stored_NodeKey)
+			if err != nil {
+				return err
+			}
+
+			newSlot := uuid.New()
+			sets[newSlot], err = AuthEnc(userdata.FilenameKey, NodeKey)
+			if err != nil {
+				return err
+			}
+
+			index[filename] = newSlot
+			newSlots = append(newSlots, newSlot)
+			dropped = append(dropped, slot)
+		}
+		if len(sets) == 0 {
+			userdata.setSlots(index)
+			return nil
+		}
+
+		storable_index, err := MarshalAuthEnc(index, indexKey)
+		if err != nil {
+			return err
+		}
+
+		lost, err := userdata.commit(journalEntry{
+			Sets:  sets,
+			Swaps: []journalSwap{{Key: indexUuid, Old: stored_index, New: storable_index, Undo: newSlots, Drop: dropped}},
+		})
+		if err != nil {
+			return err
+		}
+		if len(lost) == 0 {
+			userdata.setSlots(index)
+			return nil
+		}
+	}
+	return ErrConflict
+}
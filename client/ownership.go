@@ -0,0 +1,566 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// OwnerRecord names the owner of a file. It is signed by the owner when the
+// file is created, and every sharee gets a copy next to their UserFileNode,
+// stored at a uuid derived from their NodeKey. It is kept out of the node
+// itself so that appends do not depend on the length of the owner's name.
+// Next is set while the owner is handing the file over to another user;
+// until that user accepts, nobody is the owner.
+type OwnerRecord struct {
+	FileID uuid.UUID
+	Owner  string
+	Next   string
+	Sig    []byte
+}
+
+var ErrNotOwner = errors.New("only the owner of the file can do this")
+var ErrNotNextOwner = errors.New("the sender is not handing this file over to you")
+
+func (record OwnerRecord) signed() []byte {
+	return []byte(fmt.Sprintf("%s %d:%s %s", record.FileID, len(record.Owner), record.Owner, record.Next))
+}
+
+func (record *OwnerRecord) sign(signer *User) (err error) {
+	record.Sig, err = signer.sign(record.signed())
+	return err
+}
+
+// newOwnerRecord signs a record making the user the owner of a new file.
+func (userdata *User) newOwnerRecord() (record OwnerRecord, err error) {
+	record.FileID = uuid.New()
+	record.Owner = userdata.Username
+
+	err = record.sign(userdata)
+	if err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+// GetOwnerRecord retrieves the record stored with the node under NodeKey
+// and checks the owner's signature on it.
+func GetOwnerRecord(NodeKey []byte) (record OwnerRecord, err error) {
+
+	recordUuid, err := DeriveUuid(NodeKey, "OwnerRecord")
+	if err != nil {
+		return record, err
+	}
+
+	stored_record, ok := store.Get(recordUuid)
+	if !ok {
+		return record, errors.New("owner record missing")
+	}
+
+	err = UnmarshalAuthDec(NodeKey, stored_record, &record)
+	if err != nil {
+		return record, err
+	}
+
+	err = verifyBy(record.Owner, record.signed(), record.Sig)
+	if err != nil {
+		return record, errors.New("owner record not signed by its owner")
+	}
+	return record, nil
+}
+
+// isOwner reports whether the node under NodeKey is the user's own file.
+func (userdata *User) isOwner(NodeKey []byte) (owner bool, err error) {
+	record, err := GetOwnerRecord(NodeKey)
+	if err != nil {
+		return false, err
+	}
+	mine := bytes.Equal(userlib.Hash([]byte(record.Owner)), userdata.Username_hash)
+	return mine && record.Next == "", nil
+}
+
+// requireOwner is the check in front of every owner-only operation.
+func (userdata *User) requireOwner(NodeKey []byte) (err error) {
+	owner, err := userdata.isOwner(NodeKey)
+	if err != nil {
+		return err
+	}
+	if !owner {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// rekeyPending reports whether sharees have revoked users since the file's
+// keys were last rotated, and the caller is the owner, who has to rotate
+// them. The owner record is only fetched when a rotation was asked for.
+func (userdata *User) rekeyPending(file openedFile) bool {
+	if !file.LastChunk.Rekey {
+		return false
+	}
+	owner, err := userdata.isOwner(file.NodeKey)
+	return err == nil && owner
+}
+
+// The Rekey flag is only a hint: it sits in the pointer, which revoked
+// users can put back the way it was. Every revocation by a sharee also
+// counts up a counter stored under the sharee's NodeKey, which the users
+// it revoked never knew. The owner keeps the counts as of the last
+// rotation under its own NodeKey, which no sharee knows, and before every
+// write rotates the keys if any counter in the tree has moved on.
+func revocationsUuid(NodeKey []byte) (uuid.UUID, error) {
+	return DeriveUuid(NodeKey, "Revocations")
+}
+
+func seenUuid(NodeKey []byte) (uuid.UUID, error) {
+	return DeriveUuid(NodeKey, "RevocationsSeen")
+}
+
+// getRevocations returns the counter under NodeKey. Only the sharee and
+// those above it can write it, so one that is missing or can't be read
+// counts as zero.
+func getRevocations(NodeKey []byte) (count int) {
+	countUuid, err := revocationsUuid(NodeKey)
+	if err != nil {
+		return 0
+	}
+	stored_count, ok := store.Get(countUuid)
+	if !ok {
+		return 0
+	}
+	err = UnmarshalAuthDec(NodeKey, stored_count, &count)
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// countRevocations adds the counter of everyone below NodeKey to counts,
+// by a hash of their NodeKey, reading ShareMaps as sets is about to store
+// them. A ShareMap that can't be read ends the walk there.
+func countRevocations(NodeKey []byte, sets map[uuid.UUID][]byte, counts map[string]int) {
+	sharedTo, err := pendingSharedTo(NodeKey, sets)
+	if err != nil {
+		return
+	}
+	for _, uNodeKey := range sharedTo {
+		counts[hex.EncodeToString(userlib.Hash(uNodeKey)[:16])] = getRevocations(uNodeKey)
+		countRevocations(uNodeKey, sets, counts)
+	}
+}
+
+// rekeyDue reports whether the caller is the owner of file and has to
+// rotate its keys before writing to it: because a sharee asked for it, or
+// because a sharee revoked someone since the last rotation. Only the
+// owner's node has the counts seen, so sharees are done after one read.
+func (userdata *User) rekeyDue(file openedFile) (due bool, err error) {
+	if file.LastChunk.Rekey {
+		return userdata.rekeyPending(file), nil
+	}
+
+	seenUuid, err := seenUuid(file.NodeKey)
+	if err != nil {
+		return false, err
+	}
+
+	stored_seen, ok := store.Get(seenUuid)
+	if !ok {
+		return false, nil
+	}
+
+	var seen map[string]int
+	err = UnmarshalAuthDec(file.NodeKey, stored_seen, &seen)
+	if err != nil {
+		return false, err
+	}
+
+	counts := make(map[string]int)
+	countRevocations(file.NodeKey, nil, counts)
+
+	for sharee, count := range counts {
+		if count > seen[sharee] {
+			owner, err := userdata.isOwner(file.NodeKey)
+			return err == nil && owner, nil
+		}
+	}
+	return false, nil
+}
+
+// FileOwner returns the username of the owner of filename, as signed by
+// that owner.
+func (userdata *User) FileOwner(filename string) (owner string, err error) {
+	lock := userdata.fileLock(filename)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	NodeKey, err := userdata.getNodeKey(filename)
+	if err != nil {
+		return "", err
+	}
+
+	record, err := GetOwnerRecord(NodeKey)
+	if err != nil {
+		return "", err
+	}
+	return record.Owner, nil
+}
+
+// DeleteFile removes filename for its owner and everyone it was shared
+// with: every chunk, the pointer and key ring, and the UserFileNodes,
+// ShareMaps and owner records of the whole share tree. Sharees get an error
+// on their next access. Only the owner can delete a file.
+func (userdata *User) DeleteFile(filename string) (err error) {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := userdata.openFile(filename)
+	if err != nil {
+		return err
+	}
+
+	err = userdata.requireOwner(file.NodeKey)
+	if err != nil {
+		return err
+	}
+
+	NodeKeyUuid, err := userdata.slotUuid(filename)
+	if err != nil {
+		return err
+	}
+
+	ringUuid, err := DeriveUuid(file.Node.FileKey, "KeyRing")
+	if err != nil {
+		return err
+	}
+
+	entry := journalEntry{Sets: make(map[uuid.UUID][]byte)}
+
+	entry.Deletes = append(entry.Deletes, NodeKeyUuid)
+	entry.Deletes = append(entry.Deletes, chainUuids(file)...)
+	entry.Deletes = append(entry.Deletes, file.Node.LastChunkUuid, ringUuid)
+
+	err = dropSubtree(file.NodeKey, &entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = userdata.commit(entry)
+	if err != nil {
+		return err
+	}
+	userdata.getCache().forget(filename)
+
+	// the file is gone either way, a name left in the index is skipped
+	// when the FilenameKey is rotated
+	userdata.unindex(filename)
+	return nil
+}
+
+// chainUuids lists the chunks of file, as far back as the chain can be
+// followed.
+func chainUuids(file openedFile) (chunkUuids []uuid.UUID) {
+	walk := newChainWalk(file.Node.FileKey, file.LastChunk)
+	for !walk.done() {
+		chunkUuid := walk.next.Chunk
+
+		stored_chunk, ok := store.Get(chunkUuid)
+		if !ok {
+			break
+		}
+		chunkUuids = append(chunkUuids, chunkUuid)
+
+		chunk, _, err := walk.open(stored_chunk)
+		if err != nil {
+			break
+		}
+		walk.add(chunk)
+	}
+	return chunkUuids
+}
+
+var ErrTransferToSelf = errors.New("the file is already yours")
+
+// TransferOwnership hands filename, and the root of its share tree, over to
+// newOwner, who takes it with AcceptOwnership. The root UserFileNode keeps
+// every ShareMap below it, so no sharee loses access. The old owner moves to
+// a new UserFileNode under the root, keeping the file under the same name
+// as an ordinary sharee. Until newOwner accepts, owner-only operations fail
+// for everyone.
+func (userdata *User) TransferOwnership(filename string, newOwner string) (invitationPtr uuid.UUID, err error) {
+	if newOwner == userdata.Username {
+		return invitationPtr, ErrTransferToSelf
+	}
+
+	rPublicKey, ok := publicKeyOf(newOwner)
+	if !ok {
+		return invitationPtr, ErrNoSuchUser
+	}
+
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := userdata.openFile(filename)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	err = userdata.requireOwner(file.NodeKey)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	record, err := GetOwnerRecord(file.NodeKey)
+	if err != nil {
+		return invitationPtr, err
+	}
+	record.Next = newOwner
+	err = record.sign(userdata)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	sharedTo, err := GetSharedTo(file.NodeKey)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	invitationPtr = uuid.New()
+
+	invitation, err := userdata.sealInvitation(newOwner, rPublicKey, invitationPtr, invitationEnvelope{
+		NodeKey: file.NodeKey,
+		Details: InvitationDetails{Filename: filename, Size: file.LastChunk.size(), Perms: PermAll},
+	})
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	NodeKeyUuid, err := userdata.slotUuid(filename)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	// the old owner's grant is re-signed by the new owner on acceptance
+	newNodeKey := userlib.RandomBytes(16)
+	sharedTo[userdata.Username] = newNodeKey
+
+	grant := Grant{Grantor: userdata.Username, Grantee: userdata.Username, Perms: PermAll, Depth: UnlimitedReshare}
+	err = grant.sign(record.FileID, userdata)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	storable_NodeKey, err := AuthEnc(userdata.FilenameKey, newNodeKey)
+	if err != nil {
+		return invitationPtr, err
+	}
+
+	entry := journalEntry{Sets: map[uuid.UUID][]byte{
+		invitationPtr: invitation,
+		NodeKeyUuid:   storable_NodeKey,
+	}}
+
+	blobs := []struct {
+		NodeKey []byte
+		purpose string
+		data    any
+	}{
+		{file.NodeKey, "OwnerRecord", record},
+		{file.NodeKey, "ShareMap", sharedTo},
+		{newNodeKey, "UserFileNode", file.Node},
+		{newNodeKey, "OwnerRecord", record},
+		{newNodeKey, "Grants", GrantChain{grant}},
+		{newNodeKey, "ShareMap", make(ShareMap)},
+	}
+	for _, blob := range blobs {
+		blobUuid, err := DeriveUuid(blob.NodeKey, blob.purpose)
+		if err != nil {
+			return invitationPtr, err
+		}
+
+		entry.Sets[blobUuid], err = MarshalAuthEnc(blob.data, blob.NodeKey)
+		if err != nil {
+			return invitationPtr, err
+		}
+	}
+
+	_, err = userdata.commit(entry)
+	if err != nil {
+		return invitationPtr, err
+	}
+	userdata.getCache().forget(filename)
+
+	return invitationPtr, nil
+}
+
+// AcceptOwnership takes over a file senderUsername handed over with
+// TransferOwnership, storing it as filename. The new owner signs a new
+// OwnerRecord and gives a copy to everyone in the share tree, and moves
+// the root node under a NodeKey the old owner never saw.
+func (userdata *User) AcceptOwnership(senderUsername string, invitationPtr uuid.UUID, filename string) (err error) {
+	lock := userdata.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = userdata.checkFree(filename)
+	if err != nil {
+		return err
+	}
+
+	NodeKey, err := userdata.openNodeKey(senderUsername, invitationPtr)
+	if err != nil {
+		return err
+	}
+
+	record, err := GetOwnerRecord(NodeKey)
+	if err != nil {
+		return err
+	}
+	if record.Owner != senderUsername || record.Next != userdata.Username {
+		return ErrNotNextOwner
+	}
+
+	record.Owner = userdata.Username
+	record.Next = ""
+	err = record.sign(userdata)
+	if err != nil {
+		return err
+	}
+
+	entry := journalEntry{
+		Sets:    make(map[uuid.UUID][]byte),
+		Deletes: []uuid.UUID{invitationPtr},
+	}
+
+	err = userdata.setOwnerRecords(NodeKey, record, entry.Sets)
+	if err != nil {
+		return err
+	}
+
+	// the old owner knows the root's NodeKey, so the root moves
+	rootKey := userlib.RandomBytes(16)
+	err = moveRoot(NodeKey, rootKey, &entry)
+	if err != nil {
+		return err
+	}
+
+	NodeKeyUuid, err := userdata.freeSlot(filename)
+	if err != nil {
+		return err
+	}
+
+	entry.Sets[NodeKeyUuid], err = AuthEnc(userdata.FilenameKey, rootKey)
+	if err != nil {
+		return err
+	}
+
+	// grants the old owner made may expire, and are the new owner's to
+	// enforce now
+	err = userdata.schedule(filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = userdata.commitIndexed(entry, map[string]uuid.UUID{filename: NodeKeyUuid})
+	if err != nil {
+		return err
+	}
+	userdata.getCache().forget(filename)
+
+	return nil
+}
+
+// moveRoot adds to entry the blobs of the root node under oldKey, as they
+// are in entry or else in the Datastore, stored under newKey instead, and
+// deletes them under oldKey. The nodes below keep their NodeKeys.
+func moveRoot(oldKey []byte, newKey []byte, entry *journalEntry) (err error) {
+	for _, purpose := range []string{"UserFileNode", "OwnerRecord", "Grants", "ShareMap", "Revocations", "RevocationsSeen"} {
+		oldUuid, err := DeriveUuid(oldKey, purpose)
+		if err != nil {
+			return err
+		}
+		entry.Deletes = append(entry.Deletes, oldUuid)
+
+		stored, ok := entry.Sets[oldUuid]
+		if ok {
+			delete(entry.Sets, oldUuid)
+		} else {
+			stored, ok = store.Get(oldUuid)
+			if !ok {
+				continue
+			}
+		}
+
+		data, err := AuthDec(oldKey, stored)
+		if err != nil {
+			return err
+		}
+
+		newUuid, err := DeriveUuid(newKey, purpose)
+		if err != nil {
+			return err
+		}
+
+		entry.Sets[newUuid], err = AuthEnc(newKey, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOwnerRecords adds record, stored for the node under NodeKey and
+// everyone below it, to sets. The first grant of every chain is re-signed
+// by the new owner, so the chains lead from them.
+func (userdata *User) setOwnerRecords(NodeKey []byte, record OwnerRecord, sets map[uuid.UUID][]byte) (err error) {
+	recordUuid, err := DeriveUuid(NodeKey, "OwnerRecord")
+	if err != nil {
+		return err
+	}
+
+	sets[recordUuid], err = MarshalAuthEnc(record, NodeKey)
+	if err != nil {
+		return err
+	}
+
+	chain, err := GetGrants(NodeKey)
+	if err != nil {
+		return err
+	}
+
+	if len(chain) > 0 {
+		chain[0].Grantor = record.Owner
+		err = chain[0].sign(record.FileID, userdata)
+		if err != nil {
+			return err
+		}
+
+		chainUuid, err := DeriveUuid(NodeKey, "Grants")
+		if err != nil {
+			return err
+		}
+
+		sets[chainUuid], err = MarshalAuthEnc(chain, NodeKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	sharedTo, err := GetSharedTo(NodeKey)
+	if err != nil {
+		return err
+	}
+
+	for _, uNodeKey := range sharedTo {
+		err = userdata.setOwnerRecords(uNodeKey, record, sets)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Permission is a set of rights over a shared file. Every sharee can read;
+// the rest are granted per invitation and can only be passed on, never
+// widened, when resharing.
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermAppend
+	PermWrite // overwrite with StoreFile
+	PermReshare
+
+	PermAll = PermRead | PermAppend | PermWrite | PermReshare
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// InviteOption configures an invitation made by CreateInvitation.
+type InviteOption func(*inviteOptions)
+
+type inviteOptions struct {
+	perms    Permission
+	depth    int
+	depthSet bool
+	acceptBy time.Time
+	until    time.Time
+	message  string
+}
+
+// WithPermissions limits what the recipient may do with the file. Read is
+// always included. Without it the recipient gets the sender's permissions.
+func WithPermissions(perms Permission) InviteOption {
+	return func(options *inviteOptions) {
+		options.perms = perms | PermRead
+	}
+}
+
+// require fails unless node grants every permission in perms.
+func (node UserFileNode) require(perms Permission) (err error) {
+	if node.Perms&perms != perms {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// The file's keys are stored in the UserFileNode padded to a fixed size,
+// so that how many digits they happen to have doesn't show in the size of
+// every append.
+const (
+	writeKeySize  = 4096
+	verifyKeySize = 1024
+)
+
+func packKey(key any, size int) (packed []byte, err error) {
+	packed, err = json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(packed) > size {
+		return nil, errors.New("key too long to pack")
+	}
+	return append(packed, bytes.Repeat([]byte(" "), size-len(packed))...), nil
+}
+
+// newWriteKeys gives node, the node of a new file, a fresh pair of keys for
+// writing and one for appending.
+func (node *UserFileNode) newWriteKeys() (err error) {
+	writeKey, verifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return err
+	}
+
+	node.WriteKey, err = packKey(writeKey, writeKeySize)
+	if err != nil {
+		return err
+	}
+
+	node.VerifyKey, err = packKey(verifyKey, verifyKeySize)
+	if err != nil {
+		return err
+	}
+
+	appendKey, appendVerifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return err
+	}
+
+	node.AppendKey, err = packKey(appendKey, writeKeySize)
+	if err != nil {
+		return err
+	}
+
+	node.AppendVerifyKey, err = packKey(appendVerifyKey, verifyKeySize)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pointer ChunkPointer) signed() []byte {
+	signed := append(append([]byte{}, pointer.Chunk[:]...), pointer.Hash...)
+	return append(signed, pointer.Size...)
+}
+
+func (pointer ChunkPointer) baseSigned() []byte {
+	return append(append([]byte("base "), pointer.Base[:]...), pointer.BaseHash...)
+}
+
+func signWith(packed []byte, data []byte) (sig []byte, err error) {
+	var signKey userlib.DSSignKey
+	err = json.Unmarshal(packed, &signKey)
+	if err != nil {
+		return nil, err
+	}
+	return userlib.DSSign(signKey, data)
+}
+
+func verifyWith(packed []byte, data []byte, sig []byte) (err error) {
+	var verifyKey userlib.DSVerifyKey
+	err = json.Unmarshal(packed, &verifyKey)
+	if err != nil {
+		return err
+	}
+	return userlib.DSVerify(verifyKey, data, sig)
+}
+
+// signPointer signs pointer with the file's write key, or failing that its
+// append key. Only users with write permission are given the write key, and
+// only users with append permission the append key, so a read-only sharee
+// holding the FileKey still cannot make a pointer other users accept.
+//
+// With the write key, the new last chunk also becomes the pointer's Base.
+// An appender without it carries the Base of the pointer it appends to
+// over, and readers only take a pointer signed with the append key if its
+// chain passes through that Base: it can add to what a writer left, but
+// not replace it.
+//
+// The Rekey flag is not signed, since any sharee may set it, including
+// read-only ones who hold neither key. Setting it only makes the owner
+// look at the revocation counters, and clearing it does not stop the
+// rotation they call for, see rekeyDue.
+func (node UserFileNode) signPointer(pointer *ChunkPointer) (err error) {
+	if node.WriteKey == nil {
+		if node.AppendKey == nil {
+			return ErrPermissionDenied
+		}
+		pointer.Sig, err = signWith(node.AppendKey, pointer.signed())
+		return err
+	}
+
+	pointer.Base = pointer.Chunk
+	pointer.BaseHash = pointer.Hash
+	pointer.BaseSig, err = signWith(node.WriteKey, pointer.baseSigned())
+	if err != nil {
+		return err
+	}
+
+	pointer.Sig, err = signWith(node.WriteKey, pointer.signed())
+	return err
+}
+
+// verifyPointer checks that pointer was signed by someone allowed to write
+// or append. The walk of its chain checks that it passes through the Base.
+func (node UserFileNode) verifyPointer(pointer ChunkPointer) (err error) {
+	if pointer.Base != uuid.Nil {
+		err = verifyWith(node.VerifyKey, pointer.baseSigned(), pointer.BaseSig)
+		if err != nil {
+			return errors.New("last chunk not written by anyone allowed to")
+		}
+	}
+
+	err = verifyWith(node.VerifyKey, pointer.signed(), pointer.Sig)
+	if err == nil {
+		return nil
+	}
+
+	if pointer.Base != uuid.Nil && node.AppendVerifyKey != nil {
+		err = verifyWith(node.AppendVerifyKey, pointer.signed(), pointer.Sig)
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.New("last chunk not written by anyone allowed to")
+}
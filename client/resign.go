@@ -0,0 +1,462 @@
+package client
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Only the newest version of a user's keys verifies, so after a rotation
+// everything the user signed that is still in use is signed again: the
+// owner records, grants, accept markers and pending invitations in the
+// share trees of their files, the invitations they made for groups, the
+// notes they left in inboxes and the groups they administer. Only what
+// verifies under an older version of the user's own keys is signed again,
+// so nothing anyone else stored there gets the new signature.
+type resigner struct {
+	user  *User
+	chain []keyVersion
+
+	// whom the user shared files with, for their notes and group
+	// invitations
+	recipients map[string]bool
+	groups     map[string]bool
+}
+
+// signAgain signs again, with the caller's current keys, everything they
+// signed with older ones. Files are done one by one, under their file lock,
+// each in a journal entry of its own.
+func (userdata *User) signAgain() (err error) {
+	chain, ok := keyChain(userdata.Username)
+	if !ok {
+		return ErrStaleSession
+	}
+	r := resigner{user: userdata, chain: chain, recipients: make(map[string]bool), groups: make(map[string]bool)}
+
+	// the groups go first, files shared with them are resolved through them
+	err = r.adminGroups()
+	if err != nil {
+		return err
+	}
+
+	indexKey, indexUuid, err := fileIndexKey(userdata.FilenameKey)
+	if err != nil {
+		return err
+	}
+	index, _, err := getIndex(indexKey, indexUuid)
+	if err != nil {
+		return err
+	}
+	filenames := make([]string, 0, len(index))
+	for filename := range index {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		err = r.file(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	for recipient := range r.groups {
+		err = r.groupSlots(recipient)
+		if err != nil {
+			return err
+		}
+	}
+	for recipient := range r.recipients {
+		err = r.notes(recipient)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitSwaps commits the swaps build makes, building them again while any
+// of them lose to someone else's change.
+func (userdata *User) commitSwaps(build func() (swaps []journalSwap, err error)) (err error) {
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		swaps, err := build()
+		if err != nil || len(swaps) == 0 {
+			return err
+		}
+
+		lost, err := userdata.commit(journalEntry{Swaps: swaps})
+		if err != nil || len(lost) == 0 {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// file signs again what the user signed in the share tree of filename,
+// from their own node down. A name the index lists that is gone, or whose
+// group reference no longer resolves, is passed over.
+func (r *resigner) file(filename string) (err error) {
+	lock := r.user.fileLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return r.user.commitSwaps(func() (swaps []journalSwap, err error) {
+		_, stored_NodeKey, ok, err := r.user.getSlot(filename)
+		if err != nil || !ok {
+			return nil, err
+		}
+		stored, err := AuthDec(r.user.FilenameKey, stored_NodeKey)
+		if err != nil {
+			return nil, err
+		}
+		NodeKey, _, err := r.user.resolveNodeKey(stored)
+		if err != nil {
+			return nil, nil
+		}
+		return r.node(NodeKey, swaps)
+	})
+}
+
+// node adds to swaps what the user signed in the node under NodeKey and
+// everyone below it. The nodes below belong to sharees, who may have
+// tampered with them, so a blob that can't be read is left as it is, and a
+// ShareMap that can't be read ends the walk there.
+func (r *resigner) node(NodeKey []byte, swaps []journalSwap) (_ []journalSwap, err error) {
+	var record OwnerRecord
+	recordUuid, err := DeriveUuid(NodeKey, "OwnerRecord")
+	if err != nil {
+		return nil, err
+	}
+	stored_record, ok := store.Get(recordUuid)
+	if ok && UnmarshalAuthDec(NodeKey, stored_record, &record) == nil {
+		if record.Owner == r.user.Username && r.user.signedBefore(r.chain, record.signed(), record.Sig) {
+			err = record.sign(r.user)
+			if err != nil {
+				return nil, err
+			}
+			swaps, err = addSwap(swaps, NodeKey, recordUuid, stored_record, record)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		swaps, err = r.grants(NodeKey, record.FileID, swaps)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	markerUuid, err := DeriveUuid(NodeKey, "Accepted")
+	if err != nil {
+		return nil, err
+	}
+	var marker acceptMarker
+	stored_marker, ok := store.Get(markerUuid)
+	if ok && UnmarshalAuthDec(NodeKey, stored_marker, &marker) == nil &&
+		marker.Username == r.user.Username && r.user.signedBefore(r.chain, acceptedSigned(NodeKey), marker.Sig) {
+		marker.Sig, err = r.user.sign(acceptedSigned(NodeKey))
+		if err != nil {
+			return nil, err
+		}
+		swaps, err = addSwap(swaps, NodeKey, markerUuid, stored_marker, marker)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sharedTo, err := GetSharedTo(NodeKey)
+	if err != nil {
+		return swaps, nil
+	}
+	for _, uNodeKey := range sharedTo {
+		swaps, err = r.node(uNodeKey, swaps)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return swaps, nil
+}
+
+// addSwap adds to swaps the swap that stores data, encrypted with NodeKey,
+// at key in place of stored.
+func addSwap(swaps []journalSwap, NodeKey []byte, key uuid.UUID, stored []byte, data any) ([]journalSwap, error) {
+	storable, err := MarshalAuthEnc(data, NodeKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(swaps, journalSwap{Key: key, Old: stored, New: storable}), nil
+}
+
+// grants adds to swaps the grants the user made in the chain under
+// NodeKey, and the invitation of the grant that leads to the node, if the
+// user made it.
+func (r *resigner) grants(NodeKey []byte, fileID uuid.UUID, swaps []journalSwap) (_ []journalSwap, err error) {
+	chainUuid, err := DeriveUuid(NodeKey, "Grants")
+	if err != nil {
+		return nil, err
+	}
+	var chain GrantChain
+	stored_chain, ok := store.Get(chainUuid)
+	if !ok || UnmarshalAuthDec(NodeKey, stored_chain, &chain) != nil || len(chain) == 0 {
+		return swaps, nil
+	}
+
+	changed := false
+	for i, grant := range chain {
+		if grant.Grantor == r.user.Username && r.user.signedBefore(r.chain, grant.signed(fileID), grant.Sig) {
+			err = chain[i].sign(fileID, r.user)
+			if err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+	}
+	if changed {
+		swaps, err = addSwap(swaps, NodeKey, chainUuid, stored_chain, chain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	last := chain[len(chain)-1]
+	if last.Grantor != r.user.Username {
+		return swaps, nil
+	}
+	if isGroup(last.Grantee) {
+		r.groups[last.Grantee] = true
+		return swaps, nil
+	}
+	if isLink(last.Grantee) || last.Invitation == uuid.Nil {
+		return swaps, nil
+	}
+	r.recipients[last.Grantee] = true
+
+	swap, ok, err := r.invitation(last)
+	if err != nil || !ok {
+		return swaps, err
+	}
+	return append(swaps, swap), nil
+}
+
+// invitation returns the swap that signs again the invitation, or the
+// tombstone of a cancellation cut short, stored for grant, if the user
+// signed it with older keys.
+func (r *resigner) invitation(grant Grant) (swap journalSwap, ok bool, err error) {
+	stored, found := store.Get(grant.Invitation)
+	if !found {
+		return swap, false, nil
+	}
+
+	if isTombstone(stored) {
+		signed := tombstoneSigned(grant.Invitation)
+		if !r.user.signedBefore(r.chain, signed, stored[len(cancelledMarker):]) {
+			return swap, false, nil
+		}
+		sig, err := r.user.sign(signed)
+		if err != nil {
+			return swap, false, err
+		}
+		tombstone := append(append([]byte{}, cancelledMarker...), sig...)
+		return journalSwap{Key: grant.Invitation, Old: stored, New: tombstone}, true, nil
+	}
+
+	if len(stored) == 0 || stored[0] != invitationVersion {
+		return swap, false, nil
+	}
+	fields, ends, err := splitFields(stored)
+	if err != nil || len(fields) != 4 {
+		return swap, false, nil
+	}
+	signed := invitationSigned(r.user.Username, grant.Grantee, grant.Invitation, stored[:ends[2]])
+	if !r.user.signedBefore(r.chain, signed, fields[3]) {
+		return swap, false, nil
+	}
+
+	sig, err := r.user.sign(signed)
+	if err != nil {
+		return swap, false, err
+	}
+	invitation := appendField(append([]byte{}, stored[:ends[2]]...), sig)
+	return journalSwap{Key: grant.Invitation, Old: stored, New: invitation}, true, nil
+}
+
+// groupSlots signs again the invitations the user made for the group
+// recipient names. Anyone can tell from the signature alone which of the
+// group's invitations are the user's, without opening them.
+func (r *resigner) groupSlots(recipient string) (err error) {
+	admin, name, err := splitGroupRecipient(recipient)
+	if err != nil {
+		return nil
+	}
+	group := Group{Name: name, Admin: admin}
+	_, filesUuid, err := groupUuids(admin, name)
+	if err != nil {
+		return err
+	}
+
+	return r.user.commitSwaps(func() (swaps []journalSwap, err error) {
+		ptrs, _, err := getGroupFiles(filesUuid)
+		if err != nil {
+			return nil, nil
+		}
+
+		stored_slots := getMany(ptrs)
+		for _, ptr := range ptrs {
+			stored_slot, ok := stored_slots[ptr]
+			if !ok {
+				continue
+			}
+			slot, err := splitGroupSlot(stored_slot)
+			if err != nil {
+				continue
+			}
+
+			signed := slot.signed(r.user.Username, group, ptr)
+			if !r.user.signedBefore(r.chain, signed, slot.sig) {
+				continue
+			}
+			slot.sig, err = r.user.sign(signed)
+			if err != nil {
+				return nil, err
+			}
+			swaps = append(swaps, journalSwap{Key: ptr, Old: stored_slot, New: slot.join()})
+		}
+		return swaps, nil
+	})
+}
+
+// notes signs again the notes the user left for recipient that are still
+// stored, by their numbers.
+func (r *resigner) notes(recipient string) (err error) {
+	bookKey, _, err := r.user.bookKeys()
+	if err != nil {
+		return err
+	}
+	countUuid, err := sentUuid(bookKey, recipient)
+	if err != nil {
+		return err
+	}
+	var sent int
+	stored_sent, ok := store.Get(countUuid)
+	if !ok {
+		return nil
+	}
+	err = UnmarshalAuthDec(bookKey, stored_sent, &sent)
+	if err != nil {
+		return err
+	}
+
+	noteUuids := make([]uuid.UUID, 0, sent)
+	for seq := 1; seq <= sent; seq++ {
+		noteUuid, err := noteLocation(r.user.Username, recipient, seq)
+		if err != nil {
+			return err
+		}
+		noteUuids = append(noteUuids, noteUuid)
+	}
+
+	return r.user.commitSwaps(func() (swaps []journalSwap, err error) {
+		stored_notes := getMany(noteUuids)
+		for _, noteUuid := range noteUuids {
+			stored_note, ok := stored_notes[noteUuid]
+			if !ok || len(stored_note) == 0 || stored_note[0] != inboxVersion {
+				continue
+			}
+			fields, _, err := splitFields(stored_note)
+			if err != nil || len(fields) != 3 {
+				continue
+			}
+
+			signed := noteSigned(recipient, noteUuid, fields[0], fields[1])
+			if !r.user.signedBefore(r.chain, signed, fields[2]) {
+				continue
+			}
+			sig, err := r.user.sign(signed)
+			if err != nil {
+				return nil, err
+			}
+			note := appendField(appendField(appendField([]byte{inboxVersion}, fields[0]), fields[1]), sig)
+			swaps = append(swaps, journalSwap{Key: noteUuid, Old: stored_note, New: note})
+		}
+		return swaps, nil
+	})
+}
+
+// adminGroups signs again the groups the user administers.
+func (r *resigner) adminGroups() (err error) {
+	listKey, listUuid, err := r.user.groupListKeys()
+	if err != nil {
+		return err
+	}
+	names, _, err := getNames(listKey, listUuid)
+	if err != nil {
+		return err
+	}
+
+	return r.user.commitSwaps(func() (swaps []journalSwap, err error) {
+		for _, name := range names {
+			groupUuid, _, err := groupUuids(r.user.Username, name)
+			if err != nil {
+				return nil, err
+			}
+			stored_group, ok := store.Get(groupUuid)
+			if !ok {
+				continue
+			}
+
+			var stored storedGroup
+			if json.Unmarshal(stored_group, &stored) != nil {
+				continue
+			}
+			signed, err := stored.signed(groupUuid)
+			if err != nil {
+				return nil, err
+			}
+			if !r.user.signedBefore(r.chain, signed, stored.Sig) {
+				continue
+			}
+
+			stored.Sig, err = r.user.sign(signed)
+			if err != nil {
+				return nil, err
+			}
+			storable_group, err := json.Marshal(stored)
+			if err != nil {
+				return nil, err
+			}
+			swaps = append(swaps, journalSwap{Key: groupUuid, Old: stored_group, New: storable_group})
+		}
+		return swaps, nil
+	})
+}
+
+// transferPending reports whether a file in the user's namespace is one
+// they are handing over with TransferOwnership. Its invitation and the
+// record at the root of its share tree are out of the user's reach, so
+// they could not be signed again.
+func (userdata *User) transferPending() (pending bool, err error) {
+	indexKey, indexUuid, err := fileIndexKey(userdata.FilenameKey)
+	if err != nil {
+		return false, err
+	}
+	index, _, err := getIndex(indexKey, indexUuid)
+	if err != nil {
+		return false, err
+	}
+
+	for filename := range index {
+		NodeKey, err := userdata.getNodeKey(filename)
+		if err != nil {
+			continue
+		}
+		record, err := GetOwnerRecord(NodeKey)
+		if err != nil {
+			continue
+		}
+		if record.Owner == userdata.Username && record.Next != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"sort"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// InviteStatus is how far an invitation has got.
+type InviteStatus int
+
+const (
+	StatusPending InviteStatus = iota
+	StatusAccepted
+	StatusCancelled
+	StatusExpired
+	StatusUnknown
+	StatusInvalid
+)
+
+func (status InviteStatus) String() string {
+	switch status {
+	case StatusPending:
+		return "pending"
+	case StatusAccepted:
+		return "accepted"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusExpired:
+		return "expired"
+	case StatusUnknown:
+		return "unknown"
+	case StatusInvalid:
+		return "invalid"
+	}
+	return "unknown"
+}
+
+// Sharee is one user in a file's share tree: who shared the file with them,
+// what their grant allows and until when, and whether they have accepted
+// it yet.
+type Sharee struct {
+	Username string
+	SharedBy string
+	Perms    Permission
+	Depth    int
+	Until    time.Time
+	Status   InviteStatus
+}
+
+// ListSharees returns everyone below the caller in the share tree of
+// filename, each after the user who shared the file with them. For the
+// owner that is everyone who can read the file, or will once they accept.
+// Every grant is verified on the way. A sharee whose grants or ShareMap
+// can't be read or don't match is listed with StatusInvalid and nothing
+// else, and their subtree is skipped: it is theirs to tamper with, and
+// must not keep the caller from seeing the rest.
+func (userdata *User) ListSharees(filename string) (sharees []Sharee, err error) {
+	lock := userdata.fileLock(filename)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	NodeKey, err := userdata.getNodeKey(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := GetOwnerRecord(NodeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedTo, err := GetSharedTo(NodeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return listSharees(userdata.Username, sharedTo, record, sharees), nil
+}
+
+func listSharees(sharedBy string, sharedTo ShareMap, record OwnerRecord, sharees []Sharee) []Sharee {
+	usernames := make([]string, 0, len(sharedTo))
+	for username := range sharedTo {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		NodeKey := sharedTo[username]
+
+		var grant Grant
+		var uSharedTo ShareMap
+		chain, err := GetGrants(NodeKey)
+		if err == nil {
+			grant, err = chain.verify(record)
+		}
+		if err == nil {
+			uSharedTo, err = GetSharedTo(NodeKey)
+		}
+
+		if err != nil || grant.Grantee != username || grant.Grantor != sharedBy {
+			sharees = append(sharees, Sharee{Username: username, SharedBy: sharedBy, Status: StatusInvalid})
+			continue
+		}
+
+		sharees = append(sharees, Sharee{
+			Username: username,
+			SharedBy: sharedBy,
+			Perms:    grant.Perms,
+			Depth:    grant.Depth,
+			Until:    grant.Until,
+			Status:   inviteStatus(NodeKey, grant),
+		})
+
+		sharees = listSharees(username, uSharedTo, record, sharees)
+	}
+	return sharees
+}
+
+// AcceptInvitation leaves an accept marker next to the node: the
+// recipient's name and their signature over a hash of the NodeKey, stored
+// under the NodeKey. Nobody else can make one for them.
+type acceptMarker struct {
+	Username string
+	Sig      []byte
+}
+
+func acceptedSigned(NodeKey []byte) []byte {
+	return append([]byte("accepted"), userlib.Hash(NodeKey)...)
+}
+
+// markAccepted adds the caller's accept marker for the node under NodeKey
+// to sets.
+func (userdata *User) markAccepted(NodeKey []byte, sets map[uuid.UUID][]byte) (err error) {
+	markerUuid, err := DeriveUuid(NodeKey, "Accepted")
+	if err != nil {
+		return err
+	}
+
+	sig, err := userdata.sign(acceptedSigned(NodeKey))
+	if err != nil {
+		return err
+	}
+
+	sets[markerUuid], err = MarshalAuthEnc(acceptMarker{userdata.Username, sig}, NodeKey)
+	return err
+}
+
+// acceptedBy returns who left the accept marker under NodeKey, or "" if
+// there is none that verifies.
+func acceptedBy(NodeKey []byte) (username string) {
+	markerUuid, err := DeriveUuid(NodeKey, "Accepted")
+	if err != nil {
+		return ""
+	}
+
+	stored_marker, ok := store.Get(markerUuid)
+	if !ok {
+		return ""
+	}
+
+	var marker acceptMarker
+	err = UnmarshalAuthDec(NodeKey, stored_marker, &marker)
+	if err != nil {
+		return ""
+	}
+
+	if verifyBy(marker.Username, acceptedSigned(NodeKey), marker.Sig) != nil {
+		return ""
+	}
+	return marker.Username
+}
+
+// inviteStatus tells whether grant, for the node under NodeKey, was
+// accepted from the grantee's accept marker, and otherwise from the
+// invitation blob. A blob that is gone without a marker was not
+// necessarily accepted, so that is unknown until the invitation expires.
+// A cancellation that was cut short can leave a cancelled sharee in the
+// tree until CancelInvitation is repeated.
+func inviteStatus(NodeKey []byte, grant Grant) InviteStatus {
+	if isGroup(grant.Grantee) {
+		return groupInviteStatus(NodeKey, grant)
+	}
+	if acceptedBy(NodeKey) == grant.Grantee {
+		return StatusAccepted
+	}
+	if grant.Invitation == uuid.Nil {
+		return StatusAccepted
+	}
+	stored_invitation, ok := store.Get(grant.Invitation)
+	if ok && isTombstone(stored_invitation) {
+		return StatusCancelled
+	}
+	if grant.inviteExpired() {
+		return StatusExpired
+	}
+	if !ok {
+		return StatusUnknown
+	}
+	return StatusPending
+}
+
+// groupInviteStatus is inviteStatus for a grant to a group, whose
+// invitation stays for every member. It is accepted once a member has left
+// their accept marker; the sharer cannot see who the members are now.
+func groupInviteStatus(NodeKey []byte, grant Grant) InviteStatus {
+	if acceptedBy(NodeKey) != "" {
+		return StatusAccepted
+	}
+	if grant.inviteExpired() {
+		return StatusExpired
+	}
+	return StatusPending
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Storage is the blob store every piece of client state lives in. The
+// default implementation is the userlib Datastore.
+type Storage interface {
+	Get(key uuid.UUID) (value []byte, ok bool)
+	Set(key uuid.UUID, value []byte)
+	Delete(key uuid.UUID)
+
+	// CompareAndSwap stores value at key only if the blob currently there is
+	// exactly old. A nil old means key must not exist yet.
+	CompareAndSwap(key uuid.UUID, old []byte, value []byte) (swapped bool)
+}
+
+// BatchStorage is a Storage that can read or write many blobs in one round
+// trip. The batch operations in this package use it when the configured
+// Storage provides it, and fall back to one call per blob otherwise.
+type BatchStorage interface {
+	Storage
+	GetMany(keys []uuid.UUID) (values map[uuid.UUID][]byte)
+	SetMany(values map[uuid.UUID][]byte)
+}
+
+// ErrConflict is returned when another writer kept winning the race for a
+// shared pointer and the operation gave up retrying.
+var ErrConflict = errors.New("concurrent update conflict, try again")
+
+// maxRetries bounds how often a losing compare-and-swap is retried.
+const maxRetries = 64
+
+var store Storage = &datastoreStorage{}
+
+// SetStorage makes all later operations use s and returns the Storage used
+// until now. It must not be called while operations are running.
+func SetStorage(s Storage) (previous Storage) {
+	previous, store = store, s
+	return previous
+}
+
+// datastoreStorage serializes access to the process-global userlib
+// Datastore, which is what makes CompareAndSwap atomic.
+type datastoreStorage struct {
+	mu sync.Mutex
+}
+
+func (s *datastoreStorage) Get(key uuid.UUID) (value []byte, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return userlib.DatastoreGet(key)
+}
+
+func (s *datastoreStorage) Set(key uuid.UUID, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userlib.DatastoreSet(key, value)
+}
+
+func (s *datastoreStorage) Delete(key uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userlib.DatastoreDelete(key)
+}
+
+func (s *datastoreStorage) CompareAndSwap(key uuid.UUID, old []byte, value []byte) (swapped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := userlib.DatastoreGet(key)
+	if old == nil {
+		if ok {
+			return false
+		}
+	} else if !ok || !bytes.Equal(current, old) {
+		return false
+	}
+
+	userlib.DatastoreSet(key, value)
+	return true
+}
+
+func (s *datastoreStorage) GetMany(keys []uuid.UUID) (values map[uuid.UUID][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values = make(map[uuid.UUID][]byte, len(keys))
+	for _, key := range keys {
+		if value, ok := userlib.DatastoreGet(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func (s *datastoreStorage) SetMany(values map[uuid.UUID][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, value := range values {
+		userlib.DatastoreSet(key, value)
+	}
+}
+
+// getMany fetches every key that exists, batched if the store supports it.
+func getMany(keys []uuid.UUID) (values map[uuid.UUID][]byte) {
+	if batch, ok := store.(BatchStorage); ok {
+		return batch.GetMany(keys)
+	}
+
+	values = make(map[uuid.UUID][]byte, len(keys))
+	for _, key := range keys {
+		if value, ok := store.Get(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func setMany(values map[uuid.UUID][]byte) {
+	if batch, ok := store.(BatchStorage); ok {
+		batch.SetMany(values)
+		return
+	}
+
+	for key, value := range values {
+		store.Set(key, value)
+	}
+}
+
+// The userlib Keystore is process-global and unsynchronized as well.
+var keystoreMu sync.RWMutex
+
+func KeystoreGet(key string) (value userlib.PublicKeyType, ok bool) {
+	keystoreMu.RLock()
+	defer keystoreMu.RUnlock()
+	return userlib.KeystoreGet(key)
+}
+
+func KeystoreSet(key string, value userlib.PublicKeyType) (err error) {
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+	return userlib.KeystoreSet(key, value)
+}
@@ -8,8 +8,8 @@ import (
 	// about unused imports.
 	_ "encoding/hex"
 	_ "errors"
-	_ "strconv"
-	_ "strings"
+	"strconv"
+	"strings"
 	"testing"
 
 	_ "github.com/google/uuid"
@@ -42,6 +42,95 @@ const contentThree = "cryptocurrency!"
 const charstring100 = "f6YRmXB34kj55CWd6yinBhjjjkkhUbq6SE2XKmK97LiJ7YhEZmbY89BiE33DiNyMM8QPMzcCFn55GqLie3558tz4N6SuzhWPAM3f"
 const charstring200 = "XzKbkkP9cX2xcpUeNv6E0ySfXEf1vur4kva0bDhJ0rqvSANS4jRbHDe2qGjchcJStfF4B4BCBGtZep7paCByu6iSyPix95FyGzfMZ5W6jbgkqtm4XcryGR6nQKm5Mr3jSaw6T4bwPr9YA0CUBUYmKbgCnbhV7vtCLzZ2mDavBvf6Ha2h8gbXWaD5UpnQH4DqdzPTVttM"
 
+// crashingStorage passes everything through to the real Storage, but
+// simulates a crash by panicking right after its last allowed write.
+type crashingStorage struct {
+	client.Storage
+	writesLeft int
+}
+
+type simulatedCrash struct{}
+
+func (s *crashingStorage) wrote() {
+	s.writesLeft--
+	if s.writesLeft == 0 {
+		panic(simulatedCrash{})
+	}
+}
+
+func (s *crashingStorage) Set(key userlib.UUID, value []byte) {
+	s.Storage.Set(key, value)
+	s.wrote()
+}
+
+func (s *crashingStorage) Delete(key userlib.UUID) {
+	s.Storage.Delete(key)
+	s.wrote()
+}
+
+func (s *crashingStorage) CompareAndSwap(key userlib.UUID, old []byte, value []byte) (swapped bool) {
+	swapped = s.Storage.CompareAndSwap(key, old, value)
+	s.wrote()
+	return swapped
+}
+
+// recordingStorage passes everything through to the real Storage, and
+// records the key of every access, and of every swap that won in order.
+type recordingStorage struct {
+	client.Storage
+	keys    map[userlib.UUID]bool
+	swapped []userlib.UUID
+}
+
+func (s *recordingStorage) Get(key userlib.UUID) (value []byte, ok bool) {
+	s.keys[key] = true
+	return s.Storage.Get(key)
+}
+
+func (s *recordingStorage) Set(key userlib.UUID, value []byte) {
+	s.keys[key] = true
+	s.Storage.Set(key, value)
+}
+
+func (s *recordingStorage) Delete(key userlib.UUID) {
+	s.keys[key] = true
+	s.Storage.Delete(key)
+}
+
+func (s *recordingStorage) CompareAndSwap(key userlib.UUID, old []byte, value []byte) (swapped bool) {
+	s.keys[key] = true
+	swapped = s.Storage.CompareAndSwap(key, old, value)
+	if swapped {
+		s.swapped = append(s.swapped, key)
+	}
+	return swapped
+}
+
+// failingStorage passes everything through to the real Storage, except for
+// one read, which comes back missing or, if tamper is set, tampered with.
+type failingStorage struct {
+	client.Storage
+	readsLeft int
+	tamper    bool
+	failed    bool
+}
+
+func (s *failingStorage) Get(key userlib.UUID) (value []byte, ok bool) {
+	value, ok = s.Storage.Get(key)
+	s.readsLeft--
+	if s.readsLeft != 0 || !ok {
+		return value, ok
+	}
+
+	s.failed = true
+	if !s.tamper {
+		return nil, false
+	}
+	tampered := append([]byte{}, value...)
+	tampered[len(tampered)-1] ^= 1
+	return tampered, true
+}
+
 // ================================================
 // Describe(...) blocks help you organize your tests
 // into functional categories. They can be nested into
@@ -89,6 +178,13 @@ var _ = Describe("Client Tests", func() {
 		userlib.KeystoreClear()
 	})
 
+	measureBandwidth := func(probe func()) (bandwidth int) {
+		before := userlib.DatastoreGetBandwidth()
+		probe()
+		after := userlib.DatastoreGetBandwidth()
+		return after - before
+	}
+
 	Describe("Basic Tests", func() {
 
 		Specify("Basic Test: Testing InitUser/GetUser on a single user.", func() {
@@ -662,13 +758,6 @@ var _ = Describe("Client Tests", func() {
 
 		})
 
-		measureBandwidth := func(probe func()) (bandwidth int) {
-			before := userlib.DatastoreGetBandwidth()
-			probe()
-			after := userlib.DatastoreGetBandwidth()
-			return after - before
-		}
-
 		Specify("Bandwith Tests", func() {
 			alice, err = client.InitUser(charstring100, defaultPassword)
 			Expect(err).To(BeNil())
@@ -781,4 +870,3406 @@ var _ = Describe("Client Tests", func() {
 		})
 
 	})
+
+	Describe("Concurrency Tests", func() {
+
+		Specify("Concurrent appends from many sessions never lose content", func() {
+			const writers = 8
+			const appendsPerWriter = 5
+
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Opening %d sessions, half as Alice and half as Bob.", writers)
+			sessions := make([]*client.User, writers)
+			filenames := make([]string, writers)
+			for i := range sessions {
+				if i%2 == 0 {
+					sessions[i], err = client.GetUser("alice", defaultPassword)
+					filenames[i] = aliceFile
+				} else {
+					sessions[i], err = client.GetUser("bob", defaultPassword)
+					filenames[i] = bobFile
+				}
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Appending from every session at once.")
+			type result struct {
+				appended []string
+				err      error
+			}
+			done := make(chan result)
+			for i := range sessions {
+				go func(i int) {
+					var r result
+					for j := 0; j < appendsPerWriter && r.err == nil; j++ {
+						piece := "<" + strconv.Itoa(i) + "-" + strconv.Itoa(j) + ">"
+						r.err = sessions[i].AppendToFile(filenames[i], []byte(piece))
+						for r.err == client.ErrConflict {
+							r.err = sessions[i].AppendToFile(filenames[i], []byte(piece))
+						}
+						if r.err == nil {
+							r.appended = append(r.appended, piece)
+						}
+					}
+					done <- r
+				}(i)
+			}
+
+			var pieces []string
+			for range sessions {
+				r := <-done
+				Expect(r.err).To(BeNil())
+				pieces = append(pieces, r.appended...)
+			}
+
+			userlib.DebugMsg("Checking that every append made it into the file.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(strings.HasPrefix(string(data), contentOne)).To(BeTrue())
+
+			expectedLength := len(contentOne)
+			for _, piece := range pieces {
+				Expect(strings.Count(string(data), piece)).To(Equal(1))
+				expectedLength += len(piece)
+			}
+			Expect(len(data)).To(Equal(expectedLength))
+		})
+
+		Specify("Concurrent StoreFile of a new file leaves one consistent file", func() {
+			const writers = 6
+
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			sessions := make([]*client.User, writers)
+			for i := range sessions {
+				sessions[i], err = client.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Storing %s from every session at once.", aliceFile)
+			done := make(chan error)
+			for i := range sessions {
+				go func(i int) {
+					done <- sessions[i].StoreFile(aliceFile, []byte(strconv.Itoa(i)))
+				}(i)
+			}
+			for range sessions {
+				Expect(<-done).To(BeNil())
+			}
+
+			userlib.DebugMsg("Checking that the file holds exactly one session's content and still appends.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(data)).To(Equal(1))
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			data, err = sessions[0].LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(HaveSuffix(contentTwo))
+			Expect(len(data)).To(Equal(1 + len(contentTwo)))
+		})
+
+		Specify("One session shared by many goroutines", func() {
+			const workers = 6
+
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Storing, appending, loading and sharing through the same Alice session at once.")
+			// worker does one session's share of the work and returns what
+			// it loaded back, so the spec goroutine can check it
+			worker := func(i int) (data []byte, err error) {
+				filename := "file" + strconv.Itoa(i)
+
+				err = alice.StoreFile(filename, []byte(contentOne))
+				if err != nil {
+					return nil, err
+				}
+				err = alice.AppendToFile(filename, []byte(contentTwo))
+				if err != nil {
+					return nil, err
+				}
+				err = alice.AppendToFile(aliceFile, []byte("<"+strconv.Itoa(i)+">"))
+				if err != nil {
+					return nil, err
+				}
+
+				data, err = alice.LoadFile(filename)
+				if err != nil {
+					return nil, err
+				}
+				_, err = alice.LoadFile(aliceFile)
+				if err != nil {
+					return nil, err
+				}
+
+				recipient := "bob"
+				if i%2 == 1 {
+					recipient = "charles"
+				}
+				_, err = alice.CreateInvitation(filename, recipient)
+				return data, err
+			}
+
+			type result struct {
+				data []byte
+				err  error
+			}
+			done := make(chan result)
+			for i := 0; i < workers; i++ {
+				go func(i int) {
+					data, err := worker(i)
+					done <- result{data, err}
+				}(i)
+			}
+			for i := 0; i < workers; i++ {
+				r := <-done
+				Expect(r.err).To(BeNil())
+				Expect(r.data).To(Equal([]byte(contentOne + contentTwo)))
+			}
+
+			userlib.DebugMsg("Checking that every append to %s landed.", aliceFile)
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			for i := 0; i < workers; i++ {
+				Expect(strings.Count(string(data), "<"+strconv.Itoa(i)+">")).To(Equal(1))
+			}
+
+			userlib.DebugMsg("Sharing %s with Bob and Charles in parallel.", aliceFile)
+			invites := make(chan error)
+			recipients := map[string]*client.User{"bob": bob, "charles": charles}
+			for name, recipient := range recipients {
+				go func(name string, recipient *client.User) {
+					invite, err := alice.CreateInvitation(aliceFile, name)
+					if err == nil {
+						err = recipient.AcceptInvitation("alice", invite, aliceFile)
+					}
+					invites <- err
+				}(name, recipient)
+			}
+			Expect(<-invites).To(BeNil())
+			Expect(<-invites).To(BeNil())
+
+			bobData, err := bob.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(bobData).To(Equal(data))
+
+			charlesData, err := charles.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(charlesData).To(Equal(data))
+		})
+
+	})
+
+	Describe("Cache Tests", func() {
+
+		Specify("Loading an unchanged file from the cache costs one pointer fetch", func() {
+			userlib.DebugMsg("Initializing user Alice with caching on.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			alice.SetCaching(true)
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			for i := 0; i < 10; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(charstring100))
+				Expect(err).To(BeNil())
+			}
+
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Measuring warm loads of a long and a short file.")
+			var data []byte
+			bwLong := measureBandwidth(func() {
+				data, err = alice.LoadFile(aliceFile)
+			})
+			Expect(err).To(BeNil())
+			Expect(len(data)).To(Equal(len(contentOne) + 10*len(charstring100)))
+
+			bwShort := measureBandwidth(func() {
+				data, err = alice.LoadFile(bobFile)
+			})
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			Expect(bwLong).To(Equal(bwShort))
+
+			userlib.DebugMsg("Checking that an uncached session pays for the whole file.")
+			bwUncached := measureBandwidth(func() {
+				data, err = aliceLaptop.LoadFile(aliceFile)
+			})
+			Expect(err).To(BeNil())
+			Expect(bwUncached).To(BeNumerically(">", 10*bwLong))
+
+			userlib.DebugMsg("Checking that changing the returned slice leaves the cache alone.")
+			data[0] = 'X'
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(HavePrefix(contentOne))
+		})
+
+		Specify("Cached sessions see other users' appends and lose access on revoke", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles, all caching.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			alice.SetCaching(true)
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			bob.SetCaching(true)
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			charles.SetCaching(true)
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob appends; Alice's cached session must notice.")
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Alice overwrites; Bob's cached session must notice.")
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+
+			userlib.DebugMsg("Alice revokes Bob; his cache must not keep him in.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Charles's cached node was re-keyed, he must follow it.")
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree + contentTwo)))
+		})
+
+	})
+
+	Describe("Batch Tests", func() {
+
+		Specify("StoreFiles/LoadFiles mix new and existing files and report errors per file", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice overwrites aliceFile and creates two files in one batch.")
+			errs := alice.StoreFiles(map[string][]byte{
+				aliceFile:   []byte(contentTwo),
+				charlesFile: []byte(contentOne),
+				dorisFile:   []byte(contentThree),
+			})
+			Expect(errs).To(BeEmpty())
+
+			userlib.DebugMsg("Bob sees the overwrite through his share.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			err = alice.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Loading a batch that includes a file Alice does not have.")
+			contents, errs := alice.LoadFiles([]string{aliceFile, charlesFile, dorisFile, eveFile})
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[eveFile]).ToNot(BeNil())
+			Expect(contents).To(Equal(map[string][]byte{
+				aliceFile:   []byte(contentTwo),
+				charlesFile: []byte(contentOne + contentTwo),
+				dorisFile:   []byte(contentThree),
+			}))
+
+			userlib.DebugMsg("Checking that the batch agrees with single-file loads.")
+			for _, filename := range []string{aliceFile, charlesFile, dorisFile} {
+				data, err = alice.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(contents[filename]))
+			}
+		})
+
+		Specify("LoadFiles fails only the tampered file in a batch", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			errs := alice.StoreFiles(map[string][]byte{
+				aliceFile: []byte(contentOne),
+				bobFile:   []byte(contentTwo),
+			})
+			Expect(errs).To(BeEmpty())
+
+			userlib.DebugMsg("Tampering with every blob Alice stored after her user struct.")
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			err = alice.StoreFile(frankFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			for key, value := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					value[len(value)-1] ^= 1
+					userlib.DatastoreSet(key, value)
+				}
+			}
+
+			contents, errs := alice.LoadFiles([]string{aliceFile, bobFile, frankFile})
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[frankFile]).ToNot(BeNil())
+			Expect(contents[aliceFile]).To(Equal([]byte(contentOne)))
+			Expect(contents[bobFile]).To(Equal([]byte(contentTwo)))
+		})
+	})
+
+	Describe("Crash Recovery Tests", func() {
+
+		// crashAfter runs op, crashing it right after its writes-th write,
+		// and reports whether op got that far.
+		crashAfter := func(writes int, op func()) (crashed bool) {
+			crashing := &crashingStorage{writesLeft: writes}
+			crashing.Storage = client.SetStorage(crashing)
+			defer client.SetStorage(crashing.Storage)
+
+			defer func() {
+				if r := recover(); r != nil {
+					if _, ok := r.(simulatedCrash); !ok {
+						panic(r)
+					}
+					crashed = true
+				}
+			}()
+			op()
+			return false
+		}
+
+		load := func(username string, filename string) string {
+			user, err := client.GetUser(username, defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := user.LoadFile(filename)
+			if err != nil {
+				return "<error>"
+			}
+			return string(data)
+		}
+
+		// For every write op makes, crash op right after that write, log the
+		// crashed user back in and check that the operation was either rolled
+		// back or completed, leaving no stray blobs in the Datastore.
+		crashEverywhere := func(setup func(), op func(), state func() []string) {
+			reset := func() {
+				userlib.DatastoreClear()
+				userlib.KeystoreClear()
+				setup()
+			}
+
+			reset()
+			oldState := state()
+			oldCount := len(userlib.DatastoreGetMap())
+			op()
+			newState := state()
+			newCount := len(userlib.DatastoreGetMap())
+			Expect(newState).ToNot(Equal(oldState))
+
+			for writes := 1; ; writes++ {
+				reset()
+				if !crashAfter(writes, op) {
+					userlib.DebugMsg("Checked crashes after each of %d writes.", writes-1)
+					break
+				}
+
+				// the first load logs the crashed user in, which recovers
+				// once the crashed session's lease on its entry is up
+				clock, restoreClock := client.UseFakeClock()
+				clock.Advance(2)
+				current := state()
+				count := len(userlib.DatastoreGetMap())
+				restoreClock()
+				Expect([]any{current, count}).To(Or(
+					Equal([]any{oldState, oldCount}),
+					Equal([]any{newState, newCount}),
+				), "crash after write %d", writes)
+			}
+		}
+
+		Specify("StoreFile of a new file", func() {
+			crashEverywhere(func() {
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				err = alice.StoreFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}, func() {
+				alice.StoreFile(aliceFile, []byte(contentOne))
+			}, func() []string {
+				return []string{load("alice", aliceFile), load("alice", bobFile)}
+			})
+		})
+
+		Specify("StoreFile and AppendToFile on a shared file", func() {
+			setup := func() {
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				bob, err = client.InitUser("bob", defaultPassword)
+				Expect(err).To(BeNil())
+
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				invite, err := alice.CreateInvitation(aliceFile, "bob")
+				Expect(err).To(BeNil())
+				err = bob.AcceptInvitation("alice", invite, bobFile)
+				Expect(err).To(BeNil())
+			}
+			state := func() []string {
+				return []string{load("alice", aliceFile), load("bob", bobFile)}
+			}
+
+			userlib.DebugMsg("Crashing an overwrite.")
+			crashEverywhere(setup, func() {
+				alice.StoreFile(aliceFile, []byte(contentTwo))
+			}, state)
+
+			userlib.DebugMsg("Crashing an append.")
+			crashEverywhere(setup, func() {
+				alice.AppendToFile(aliceFile, []byte(contentTwo))
+			}, state)
+		})
+
+		Specify("CreateInvitation and AcceptInvitation", func() {
+			var invite userlib.UUID
+			setup := func() {
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				bob, err = client.InitUser("bob", defaultPassword)
+				Expect(err).To(BeNil())
+
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				err = bob.StoreFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Crashing an invitation.")
+			crashEverywhere(setup, func() {
+				invite, _ = alice.CreateInvitation(aliceFile, "bob")
+			}, func() []string {
+				// a finished invitation only shows in the Datastore count
+				return []string{load("alice", aliceFile), strconv.Itoa(len(userlib.DatastoreGetMap()))}
+			})
+
+			userlib.DebugMsg("Crashing an acceptance.")
+			crashEverywhere(func() {
+				setup()
+				invite, err = alice.CreateInvitation(aliceFile, "bob")
+				Expect(err).To(BeNil())
+			}, func() {
+				bob.AcceptInvitation("alice", invite, aliceFile)
+			}, func() []string {
+				return []string{load("bob", aliceFile)}
+			})
+		})
+
+		Specify("An entry is only recovered once its session's lease is up", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice's revocation stops after its first write, like a slow session.")
+			Expect(crashAfter(3, func() {
+				alice.RevokeAccess(aliceFile, "bob")
+			})).To(BeTrue())
+			before := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Logging in again within the lease leaves the entry alone.")
+			aliceAgain, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before))
+
+			userlib.DebugMsg("Once the lease is up the entry is rolled forward.")
+			clock, restoreClock := client.UseFakeClock()
+			defer restoreClock()
+			clock.Advance(2)
+			aliceAgain, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).ToNot(Equal(before))
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err := aliceAgain.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("A recovered entry does not write over a later operation", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice's invitation for Bob stops right after it is journaled.")
+			Expect(crashAfter(2, func() {
+				alice.CreateInvitation(aliceFile, "bob")
+			})).To(BeTrue())
+
+			userlib.DebugMsg("Another session shares the file with Charles meanwhile.")
+			aliceAgain, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := aliceAgain.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Recovering Bob's invitation keeps Charles in the ShareMap.")
+			clock, restoreClock := client.UseFakeClock()
+			defer restoreClock()
+			clock.Advance(2)
+			aliceAgain, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceAgain.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("RotateFilenameKey", func() {
+			crashEverywhere(func() {
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				bob, err = client.InitUser("bob", defaultPassword)
+				Expect(err).To(BeNil())
+
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				err = bob.StoreFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				invite, err := bob.CreateInvitation(bobFile, "alice")
+				Expect(err).To(BeNil())
+				err = alice.AcceptInvitation("bob", invite, bobFile)
+				Expect(err).To(BeNil())
+			}, func() {
+				alice.RotateFilenameKey()
+			}, func() []string {
+				// the files load either way, only the Datastore count tells
+				// whether the old slots are gone
+				return []string{load("alice", aliceFile), load("alice", bobFile), strconv.Itoa(len(userlib.DatastoreGetMap()))}
+			})
+		})
+
+		Specify("RotateKeys", func() {
+			crashEverywhere(func() {
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				bob, err = client.InitUser("bob", defaultPassword)
+				Expect(err).To(BeNil())
+
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				invite, err := alice.CreateInvitation(aliceFile, "bob")
+				Expect(err).To(BeNil())
+				err = bob.AcceptInvitation("alice", invite, bobFile)
+				Expect(err).To(BeNil())
+			}, func() {
+				alice.RotateKeys()
+			}, func() []string {
+				user, err := client.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				// the grant only lists as accepted once it is signed again
+				sharees, err := user.ListSharees(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(sharees).To(HaveLen(1))
+				return []string{strconv.Itoa(user.KeyVersion), load("alice", aliceFile), sharees[0].Status.String()}
+			})
+
+			userlib.DebugMsg("The new keys sign and open invitations.")
+			aliceAgain, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := aliceAgain.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile+"3")
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile+"2", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile+"2", "alice")
+			Expect(err).To(BeNil())
+			err = aliceAgain.AcceptInvitation("bob", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("RevokeAccess", func() {
+			crashEverywhere(func() {
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				bob, err = client.InitUser("bob", defaultPassword)
+				Expect(err).To(BeNil())
+				charles, err = client.InitUser("charles", defaultPassword)
+				Expect(err).To(BeNil())
+				doris, err = client.InitUser("doris", defaultPassword)
+				Expect(err).To(BeNil())
+
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				err = alice.AppendToFile(aliceFile, []byte(contentThree))
+				Expect(err).To(BeNil())
+
+				for _, share := range []struct {
+					sender    *client.User
+					from      string
+					recipient *client.User
+					to        string
+				}{
+					{alice, "alice", bob, "bob"},
+					{alice, "alice", charles, "charles"},
+					{charles, "charles", doris, "doris"},
+				} {
+					invite, err := share.sender.CreateInvitation(aliceFile, share.to)
+					Expect(err).To(BeNil())
+					err = share.recipient.AcceptInvitation(share.from, invite, aliceFile)
+					Expect(err).To(BeNil())
+				}
+			}, func() {
+				alice.RevokeAccess(aliceFile, "bob")
+			}, func() []string {
+				return []string{
+					load("alice", aliceFile) + strconv.Itoa(len(userlib.DatastoreGetMap())),
+					load("bob", aliceFile),
+					load("charles", aliceFile),
+					load("doris", aliceFile),
+				}
+			})
+		})
+	})
+
+	Describe("Revocation Failure Tests", func() {
+
+		Specify("A revocation that fails at any read leaves the file intact", func() {
+			setup := func() {
+				userlib.DatastoreClear()
+				userlib.KeystoreClear()
+
+				alice, err = client.InitUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				bob, err = client.InitUser("bob", defaultPassword)
+				Expect(err).To(BeNil())
+				charles, err = client.InitUser("charles", defaultPassword)
+				Expect(err).To(BeNil())
+
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+
+				invite, err := alice.CreateInvitation(aliceFile, "bob")
+				Expect(err).To(BeNil())
+				err = bob.AcceptInvitation("alice", invite, bobFile)
+				Expect(err).To(BeNil())
+
+				invite, err = alice.CreateInvitation(aliceFile, "charles")
+				Expect(err).To(BeNil())
+				err = charles.AcceptInvitation("alice", invite, charlesFile)
+				Expect(err).To(BeNil())
+			}
+
+			for _, tamper := range []bool{false, true} {
+				for reads := 1; ; reads++ {
+					setup()
+
+					failing := &failingStorage{readsLeft: reads, tamper: tamper}
+					failing.Storage = client.SetStorage(failing)
+					err = alice.RevokeAccess(aliceFile, "bob")
+					client.SetStorage(failing.Storage)
+					if !failing.failed {
+						userlib.DebugMsg("Checked failures at each of %d reads (tamper: %t).", reads-1, tamper)
+						break
+					}
+					revoked := err == nil
+
+					userlib.DebugMsg("Checking the owner and Charles can still load after failing read %d.", reads)
+					data, err := alice.LoadFile(aliceFile)
+					Expect(err).To(BeNil())
+					Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+					err = alice.AppendToFile(aliceFile, []byte(contentThree))
+					Expect(err).To(BeNil())
+					data, err = charles.LoadFile(charlesFile)
+					Expect(err).To(BeNil())
+					Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+					_, err = bob.LoadFile(bobFile)
+					Expect(err == nil).To(Equal(!revoked), "failing read %d", reads)
+				}
+			}
+		})
+	})
+
+	Describe("Key Epoch Tests", func() {
+
+		shareWithBobAndCharles := func(filename string) {
+			for _, username := range []string{"bob", "charles"} {
+				invite, err := alice.CreateInvitation(filename, username)
+				Expect(err).To(BeNil())
+				recipient := bob
+				if username == "charles" {
+					recipient = charles
+				}
+				err = recipient.AcceptInvitation("alice", invite, filename)
+				Expect(err).To(BeNil())
+			}
+		}
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Revocation costs the same for a short and a long file", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(bobFile, []byte(charstring200))
+			Expect(err).To(BeNil())
+			for i := 0; i < 50; i++ {
+				err = alice.AppendToFile(bobFile, []byte(charstring200))
+				Expect(err).To(BeNil())
+			}
+
+			shareWithBobAndCharles(aliceFile)
+			shareWithBobAndCharles(bobFile)
+
+			bwShort := measureBandwidth(func() {
+				err = alice.RevokeAccess(aliceFile, "bob")
+			})
+			Expect(err).To(BeNil())
+
+			bwLong := measureBandwidth(func() {
+				err = alice.RevokeAccess(bobFile, "bob")
+			})
+			Expect(err).To(BeNil())
+			Expect(bwLong).To(Equal(bwShort))
+
+			userlib.DebugMsg("Checking everyone's access after the revocations.")
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err := charles.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(strings.Repeat(charstring200, 51))))
+		})
+
+		Specify("Sharing costs about the same for a short and a long file", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(charstring200))
+			Expect(err).To(BeNil())
+			for i := 0; i < 50; i++ {
+				err = alice.AppendToFile(bobFile, []byte(charstring200))
+				Expect(err).To(BeNil())
+			}
+
+			var invite userlib.UUID
+			bwShort := measureBandwidth(func() {
+				_, err = alice.CreateInvitation(aliceFile, "bob")
+			})
+			Expect(err).To(BeNil())
+			bwLong := measureBandwidth(func() {
+				invite, err = alice.CreateInvitation(bobFile, "charles")
+			})
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Only the digits of the size in the invitation differ.")
+			Expect(bwLong - bwShort).To(BeNumerically("<", 100))
+
+			details, err := charles.InspectInvitation("alice", invite)
+			Expect(err).To(BeNil())
+			Expect(details.Size).To(Equal(51 * len(charstring200)))
+		})
+
+		Specify("Old chunks are re-encrypted by the first load after a revocation", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			for i := 0; i < 5; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}
+			shareWithBobAndCharles(aliceFile)
+
+			bwBefore := measureBandwidth(func() {
+				_, err = alice.LoadFile(aliceFile)
+			})
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Charles's first load pays for writing the chunks back.")
+			var data []byte
+			bwFirst := measureBandwidth(func() {
+				data, err = charles.LoadFile(aliceFile)
+			})
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + strings.Repeat(contentTwo, 5))))
+			Expect(bwFirst).To(BeNumerically(">", bwBefore))
+
+			userlib.DebugMsg("Later loads cost what they did before the revocation.")
+			bwSecond := measureBandwidth(func() {
+				data, err = alice.LoadFile(aliceFile)
+			})
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + strings.Repeat(contentTwo, 5))))
+			Expect(bwSecond).To(Equal(bwBefore))
+		})
+
+		Specify("Chunks from several epochs load and append correctly", func() {
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			shareWithBobAndCharles(aliceFile)
+
+			invite, err := alice.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, dorisFile)
+			Expect(err).To(BeNil())
+
+			err = bob.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			err = charles.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			err = doris.AppendToFile(dorisFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			for i := 0; i < 2; i++ {
+				data, err := doris.LoadFile(dorisFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree + contentOne)))
+			}
+
+			_, err = bob.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = charles.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = charles.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Swapping old blobs after a revocation never goes unnoticed", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			shareWithBobAndCharles(aliceFile)
+
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			snapshot := make(map[userlib.UUID][]byte)
+			var old []userlib.UUID
+			for key, value := range userlib.DatastoreGetMap() {
+				snapshot[key] = value
+				if before[key] {
+					old = append(old, key)
+				}
+			}
+			restore := func() {
+				userlib.DatastoreClear()
+				for key, value := range snapshot {
+					userlib.DatastoreSet(key, value)
+				}
+			}
+
+			userlib.DebugMsg("Swapping each pair of the %d blobs Bob may still know about.", len(old))
+			for _, a := range old {
+				for _, b := range old {
+					if a == b {
+						continue
+					}
+					userlib.DatastoreSet(a, snapshot[b])
+					data, err := alice.LoadFile(aliceFile)
+					if err == nil {
+						Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+					}
+					restore()
+				}
+			}
+		})
+	})
+
+	Describe("Revocation Model Tests", func() {
+
+		// share has sender share filename with recipient, who stores it
+		// under the same name.
+		share := func(sender *client.User, senderName string, recipient *client.User, recipientName string) {
+			invite, err := sender.CreateInvitation(aliceFile, recipientName)
+			Expect(err).To(BeNil())
+			err = recipient.AcceptInvitation(senderName, invite, aliceFile)
+			Expect(err).To(BeNil())
+		}
+
+		expectContent := func(user *client.User, content string) {
+			data, err := user.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(content)))
+		}
+
+		// Alice owns aliceFile; she shared it with Bob and Charles, and Bob
+		// shared it with Doris, who shared it with Eve.
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			share(alice, "alice", bob, "bob")
+			share(alice, "alice", charles, "charles")
+			share(bob, "bob", doris, "doris")
+			share(doris, "doris", eve, "eve")
+		})
+
+		Specify("The owner can revoke a grandchild directly", func() {
+			err = alice.RevokeAccess(aliceFile, "doris")
+			Expect(err).To(BeNil())
+
+			_, err = doris.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = eve.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			err = bob.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			expectContent(alice, contentOne+contentTwo)
+			expectContent(charles, contentOne+contentTwo)
+
+			userlib.DebugMsg("Doris is gone from Bob's subtree too.")
+			err = bob.RevokeAccess(aliceFile, "doris")
+			Expect(err).To(Equal(client.ErrNotInSubtree))
+		})
+
+		Specify("A sharee can revoke within its own subtree", func() {
+			err = bob.RevokeAccess(aliceFile, "eve")
+			Expect(err).To(BeNil())
+
+			_, err = eve.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = eve.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Everyone else keeps access, before and after Alice finishes the rotation.")
+			expectContent(doris, contentOne)
+			expectContent(charles, contentOne)
+			err = charles.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			expectContent(alice, contentOne+contentTwo)
+
+			err = doris.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			for _, user := range []*client.User{alice, bob, charles, doris} {
+				expectContent(user, contentOne+contentTwo+contentThree)
+			}
+			_, err = eve.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Doris can be revoked by Bob afterwards, and Alice can still revoke Charles.")
+			err = bob.RevokeAccess(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			_, err = doris.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			expectContent(bob, contentOne+contentTwo+contentThree)
+		})
+
+		Specify("Disallowed revocations fail with a precise error", func() {
+			userlib.DebugMsg("Bob tries to revoke his grantor, the owner, and a sibling.")
+			Expect(bob.RevokeAccess(aliceFile, "alice")).To(Equal(client.ErrNotInSubtree))
+			Expect(doris.RevokeAccess(aliceFile, "bob")).To(Equal(client.ErrNotInSubtree))
+			Expect(bob.RevokeAccess(aliceFile, "charles")).To(Equal(client.ErrNotInSubtree))
+
+			userlib.DebugMsg("Revoking oneself or a user that doesn't exist.")
+			Expect(bob.RevokeAccess(aliceFile, "bob")).To(Equal(client.ErrRevokeSelf))
+			Expect(alice.RevokeAccess(aliceFile, "alice")).To(Equal(client.ErrRevokeSelf))
+			Expect(alice.RevokeAccess(aliceFile, "frank")).To(Equal(client.ErrNoSuchUser))
+
+			userlib.DebugMsg("Revoking a user who never got the file, or twice.")
+			frank, err = client.InitUser("frank", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.RevokeAccess(aliceFile, "frank")).To(Equal(client.ErrNotInSubtree))
+			Expect(eve.RevokeAccess(aliceFile, "doris")).To(Equal(client.ErrNotInSubtree))
+
+			Expect(alice.RevokeAccess(aliceFile, "eve")).To(BeNil())
+			Expect(alice.RevokeAccess(aliceFile, "eve")).To(Equal(client.ErrNotInSubtree))
+			Expect(doris.RevokeAccess(aliceFile, "eve")).To(Equal(client.ErrNotInSubtree))
+
+			userlib.DebugMsg("Nothing changed for anyone else along the way.")
+			for _, user := range []*client.User{alice, bob, charles, doris} {
+				expectContent(user, contentOne)
+			}
+		})
+
+		Specify("Revoked users cannot keep the owner from rotating the keys", func() {
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+
+			recording := &recordingStorage{keys: make(map[userlib.UUID]bool)}
+			recording.Storage = client.SetStorage(recording)
+			err = bob.RevokeAccess(aliceFile, "doris")
+			client.SetStorage(recording.Storage)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Doris puts her nodes back, and the pointer from before the flag was set.")
+			pointerUuid := recording.swapped[len(recording.swapped)-1]
+			datastore := userlib.DatastoreGetMap()
+			for key, value := range before {
+				if _, ok := datastore[key]; !ok {
+					userlib.DatastoreSet(key, value)
+				}
+			}
+			userlib.DatastoreSet(pointerUuid, before[pointerUuid])
+
+			userlib.DebugMsg("Alice's next append rotates the keys all the same.")
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			for _, user := range []*client.User{alice, bob, charles} {
+				expectContent(user, contentOne+contentTwo)
+			}
+
+			doris, err = client.GetUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := doris.LoadFile(aliceFile)
+			Expect(err != nil || !strings.Contains(string(data), contentTwo)).To(BeTrue())
+		})
+
+		Specify("A user reached along two paths", func() {
+			userlib.DebugMsg("Charles shares with Eve as well, who keeps his copy as eveFile.")
+			invite, err := charles.CreateInvitation(aliceFile, "eve")
+			Expect(err).To(BeNil())
+			err = eve.AcceptInvitation("charles", invite, eveFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Doris revoking Eve leaves Charles's grant alone.")
+			err = doris.RevokeAccess(aliceFile, "eve")
+			Expect(err).To(BeNil())
+			_, err = eve.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			data, err := eve.LoadFile(eveFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("The owner revoking Eve removes her everywhere.")
+			expectContent(alice, contentOne)
+			err = alice.RevokeAccess(aliceFile, "eve")
+			Expect(err).To(BeNil())
+			_, err = eve.LoadFile(eveFile)
+			Expect(err).ToNot(BeNil())
+			expectContent(charles, contentOne)
+			expectContent(doris, contentOne)
+		})
+	})
+
+	Describe("Ownership Tests", func() {
+
+		// Alice owns aliceFile and shared it with Bob, who shared it with
+		// Charles under another name. Everyone has used their namespace
+		// before, so the file is all that changes in the Datastore.
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			for _, user := range []*client.User{alice, bob, charles} {
+				err = user.StoreFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}
+		})
+
+		shareAll := func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, aliceFile)
+			Expect(err).To(BeNil())
+
+			invite, err = bob.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+		}
+
+		Specify("Everyone sees who owns a file", func() {
+			shareAll()
+
+			owner, err := alice.FileOwner(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("alice"))
+			owner, err = bob.FileOwner(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("alice"))
+			owner, err = charles.FileOwner(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("alice"))
+
+			owner, err = bob.FileOwner(bobFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("bob"))
+
+			_, err = alice.FileOwner(dorisFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Overwriting a shared file doesn't change its owner.")
+			err = bob.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			owner, err = charles.FileOwner(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("alice"))
+		})
+
+		Specify("Sharees cannot delete a file", func() {
+			shareAll()
+
+			Expect(bob.DeleteFile(aliceFile)).To(Equal(client.ErrNotOwner))
+			Expect(charles.DeleteFile(charlesFile)).To(Equal(client.ErrNotOwner))
+
+			for _, load := range []func() ([]byte, error){
+				func() ([]byte, error) { return alice.LoadFile(aliceFile) },
+				func() ([]byte, error) { return bob.LoadFile(aliceFile) },
+				func() ([]byte, error) { return charles.LoadFile(charlesFile) },
+			} {
+				data, err := load()
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+			}
+		})
+
+		Specify("The owner's delete removes the file for everyone", func() {
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+
+			shareAll()
+			err = bob.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = bob.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Only Bob's and Charles's names for the file, inboxes, notes and note counts, and Charles's append are left.")
+			after := userlib.DatastoreGetMap()
+			for key := range before {
+				Expect(after).To(HaveKey(key))
+			}
+			Expect(len(after)).To(Equal(len(before) + 9))
+
+			userlib.DebugMsg("Alice can use the name again.")
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+		})
+
+		Specify("Ownership moves to another user with the whole share tree", func() {
+			shareAll()
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			expectOwner := func(owner string) {
+				for user, filename := range map[*client.User]string{alice: aliceFile, bob: aliceFile, charles: charlesFile} {
+					current, err := user.FileOwner(filename)
+					Expect(err).To(BeNil())
+					Expect(current).To(Equal(owner))
+				}
+			}
+
+			userlib.DebugMsg("Sharees cannot give the file away, nor can Alice give it to herself.")
+			_, err = bob.TransferOwnership(aliceFile, "doris")
+			Expect(err).To(Equal(client.ErrNotOwner))
+			_, err = alice.TransferOwnership(aliceFile, "alice")
+			Expect(err).To(Equal(client.ErrTransferToSelf))
+			_, err = alice.TransferOwnership(aliceFile, "frank")
+			Expect(err).To(Equal(client.ErrNoSuchUser))
+
+			invite, err := alice.TransferOwnership(aliceFile, "doris")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("While the transfer is pending, nobody can act as the owner.")
+			Expect(alice.DeleteFile(aliceFile)).To(Equal(client.ErrNotOwner))
+			_, err = alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(Equal(client.ErrNotOwner))
+			expectOwner("alice")
+
+			userlib.DebugMsg("Only Doris can take it, and only through AcceptOwnership from Alice.")
+			Expect(bob.AcceptOwnership("alice", invite, dorisFile)).ToNot(BeNil())
+			Expect(doris.AcceptOwnership("bob", invite, dorisFile)).ToNot(BeNil())
+			Expect(doris.AcceptOwnership("alice", invite, dorisFile)).To(BeNil())
+
+			expectOwner("doris")
+			owner, err := doris.FileOwner(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("doris"))
+
+			userlib.DebugMsg("Everyone kept access without a new invitation.")
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			for user, filename := range map[*client.User]string{alice: aliceFile, bob: aliceFile, charles: charlesFile, doris: dorisFile} {
+				data, err := user.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			}
+
+			userlib.DebugMsg("Alice is an ordinary sharee now, and Doris can revoke anyone.")
+			Expect(alice.DeleteFile(aliceFile)).To(Equal(client.ErrNotOwner))
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(Equal(client.ErrNotInSubtree))
+
+			err = doris.RevokeAccess(dorisFile, "alice")
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			err = doris.RevokeAccess(dorisFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			data, err := bob.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			Expect(doris.DeleteFile(dorisFile)).To(BeNil())
+			_, err = bob.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+		Specify("The old owner loses the root of the tree with the file", func() {
+			shareAll()
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			invite, err := alice.TransferOwnership(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			changed := make(map[userlib.UUID]bool)
+			for key, value := range userlib.DatastoreGetMap() {
+				old, ok := before[key]
+				changed[key] = ok && string(old) != string(value)
+			}
+			Expect(doris.AcceptOwnership("alice", invite, dorisFile)).To(BeNil())
+
+			err = doris.RevokeAccess(dorisFile, "alice")
+			Expect(err).To(BeNil())
+			err = doris.AppendToFile(dorisFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice puts back what her transfer changed, where it is still there.")
+			for key := range userlib.DatastoreGetMap() {
+				if changed[key] {
+					userlib.DatastoreSet(key, before[key])
+				}
+			}
+
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err != nil || !strings.Contains(string(data), contentThree)).To(BeTrue())
+
+			for user, filename := range map[*client.User]string{bob: aliceFile, charles: charlesFile, doris: dorisFile} {
+				data, err := user.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentThree)))
+			}
+		})
+	})
+
+	Describe("Permission Tests", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		share := func(sender *client.User, senderName string, recipient *client.User, recipientName string, options ...client.InviteOption) (err error) {
+			invite, err := sender.CreateInvitation(aliceFile, recipientName, options...)
+			if err != nil {
+				return err
+			}
+			return recipient.AcceptInvitation(senderName, invite, aliceFile)
+		}
+
+		expectContent := func(user *client.User, content string) {
+			data, err := user.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(content)))
+		}
+
+		Specify("Read-only sharees can only read", func() {
+			Expect(share(alice, "alice", bob, "bob", client.WithPermissions(client.PermRead))).To(BeNil())
+
+			expectContent(bob, contentOne)
+			Expect(bob.AppendToFile(aliceFile, []byte(contentTwo))).To(Equal(client.ErrPermissionDenied))
+			Expect(bob.StoreFile(aliceFile, []byte(contentTwo))).To(Equal(client.ErrPermissionDenied))
+			_, err = bob.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(Equal(client.ErrPermissionDenied))
+
+			userlib.DebugMsg("Nothing Bob tried reached the file.")
+			expectContent(alice, contentOne)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			expectContent(bob, contentOne+contentTwo)
+		})
+
+		Specify("Append and write are granted separately", func() {
+			Expect(share(alice, "alice", bob, "bob", client.WithPermissions(client.PermAppend))).To(BeNil())
+			Expect(share(alice, "alice", charles, "charles", client.WithPermissions(client.PermWrite))).To(BeNil())
+
+			Expect(bob.AppendToFile(aliceFile, []byte(contentTwo))).To(BeNil())
+			Expect(bob.StoreFile(aliceFile, []byte(contentThree))).To(Equal(client.ErrPermissionDenied))
+			expectContent(alice, contentOne+contentTwo)
+
+			Expect(charles.AppendToFile(aliceFile, []byte(contentTwo))).To(Equal(client.ErrPermissionDenied))
+			Expect(charles.StoreFile(aliceFile, []byte(contentThree))).To(BeNil())
+			expectContent(bob, contentThree)
+		})
+
+		Specify("Resharing passes permissions on but never widens them", func() {
+			Expect(share(alice, "alice", bob, "bob", client.WithPermissions(client.PermReshare))).To(BeNil())
+
+			Expect(share(bob, "bob", charles, "charles", client.WithPermissions(client.PermAppend))).To(Equal(client.ErrPermissionDenied))
+			Expect(share(bob, "bob", charles, "charles")).To(BeNil())
+			Expect(share(charles, "charles", doris, "doris", client.WithPermissions(client.PermRead))).To(BeNil())
+
+			Expect(charles.AppendToFile(aliceFile, []byte(contentTwo))).To(Equal(client.ErrPermissionDenied))
+			_, err = doris.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(Equal(client.ErrPermissionDenied))
+			expectContent(doris, contentOne)
+		})
+
+		Specify("Permissions survive revocations, including one by a read-only sharee", func() {
+			Expect(share(alice, "alice", bob, "bob", client.WithPermissions(client.PermReshare))).To(BeNil())
+			Expect(share(bob, "bob", charles, "charles")).To(BeNil())
+			Expect(share(alice, "alice", doris, "doris", client.WithPermissions(client.PermAppend))).To(BeNil())
+
+			err = bob.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice rotates the keys on her next load.")
+			expectContent(alice, contentOne)
+			Expect(doris.AppendToFile(aliceFile, []byte(contentTwo))).To(BeNil())
+			Expect(bob.AppendToFile(aliceFile, []byte(contentThree))).To(Equal(client.ErrPermissionDenied))
+			expectContent(bob, contentOne+contentTwo)
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(doris.StoreFile(aliceFile, []byte(contentThree))).To(Equal(client.ErrPermissionDenied))
+			Expect(doris.AppendToFile(aliceFile, []byte(contentThree))).To(BeNil())
+			expectContent(alice, contentOne+contentTwo+contentThree)
+		})
+	})
+
+	Describe("Reshare Policy Tests", func() {
+
+		share := func(sender *client.User, senderName string, recipient *client.User, recipientName string, options ...client.InviteOption) (err error) {
+			invite, err := sender.CreateInvitation(aliceFile, recipientName, options...)
+			if err != nil {
+				return err
+			}
+			return recipient.AcceptInvitation(senderName, invite, aliceFile)
+		}
+
+		expectContent := func(users []*client.User, content string) {
+			for _, user := range users {
+				data, err := user.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(content)))
+			}
+		}
+
+		// Alice lets Bob reshare two levels deep; Bob passes one level on to
+		// Charles, and Charles shares with Doris, who cannot reshare.
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			frank, err = client.InitUser("frank", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			Expect(share(alice, "alice", bob, "bob", client.WithReshareDepth(2))).To(BeNil())
+			Expect(share(bob, "bob", charles, "charles")).To(BeNil())
+			Expect(share(charles, "charles", doris, "doris")).To(BeNil())
+		})
+
+		Specify("Resharing stops at the depth the owner allowed", func() {
+			Expect(share(doris, "doris", eve, "eve")).To(Equal(client.ErrPermissionDenied))
+
+			userlib.DebugMsg("Nobody can hand out more depth than they have.")
+			Expect(share(charles, "charles", eve, "eve", client.WithReshareDepth(1))).To(Equal(client.ErrPermissionDenied))
+			Expect(share(bob, "bob", eve, "eve", client.WithReshareDepth(2))).To(Equal(client.ErrPermissionDenied))
+			Expect(share(bob, "bob", eve, "eve", client.WithReshareDepth(client.UnlimitedReshare))).To(Equal(client.ErrPermissionDenied))
+
+			userlib.DebugMsg("Less depth, or none, is fine.")
+			Expect(share(bob, "bob", eve, "eve", client.WithReshareDepth(0))).To(BeNil())
+			Expect(share(eve, "eve", frank, "frank")).To(Equal(client.ErrPermissionDenied))
+
+			userlib.DebugMsg("The owner is never limited.")
+			Expect(share(alice, "alice", frank, "frank", client.WithReshareDepth(client.UnlimitedReshare))).To(BeNil())
+			expectContent([]*client.User{alice, bob, charles, doris, eve, frank}, contentOne)
+		})
+
+		Specify("A no-reshare grant forbids any invitation", func() {
+			Expect(share(alice, "alice", eve, "eve", client.WithReshareDepth(0))).To(BeNil())
+			Expect(share(eve, "eve", frank, "frank")).To(Equal(client.ErrPermissionDenied))
+			Expect(share(eve, "eve", frank, "frank", client.WithPermissions(client.PermRead))).To(Equal(client.ErrPermissionDenied))
+			expectContent([]*client.User{eve}, contentOne)
+		})
+
+		Specify("Policies hold across revocations and a change of owner", func() {
+			err = bob.RevokeAccess(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Charles can still share one level down, in Doris's place.")
+			Expect(share(charles, "charles", eve, "eve")).To(BeNil())
+			Expect(share(eve, "eve", frank, "frank")).To(Equal(client.ErrPermissionDenied))
+			expectContent([]*client.User{alice, bob, charles, eve}, contentOne+contentTwo)
+
+			userlib.DebugMsg("Frank takes over the file; every grant still leads from the owner.")
+			invite, err := alice.TransferOwnership(aliceFile, "frank")
+			Expect(err).To(BeNil())
+			err = frank.AcceptOwnership("alice", invite, frankFile)
+			Expect(err).To(BeNil())
+
+			_, err = eve.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(Equal(client.ErrPermissionDenied))
+			invite, err = bob.CreateInvitation(aliceFile, "doris", client.WithReshareDepth(0))
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("bob", invite, dorisFile)
+			Expect(err).To(BeNil())
+			_, err = doris.CreateInvitation(dorisFile, "eve")
+			Expect(err).To(Equal(client.ErrPermissionDenied))
+
+			err = frank.RevokeAccess(frankFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = eve.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			expectContent([]*client.User{alice, bob}, contentOne+contentTwo)
+			data, err := doris.LoadFile(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+	})
+
+	Describe("Share Tree Tests", func() {
+
+		Specify("ListSharees shows the whole tree with grants and invitation status", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(BeEmpty())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob", client.WithPermissions(client.PermAppend|client.PermReshare))
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "charles", client.WithPermissions(client.PermRead))
+			Expect(err).To(BeNil())
+			dorisInvite, err := bob.CreateInvitation(bobFile, "doris", client.WithReshareDepth(0))
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "eve")
+			Expect(err).To(BeNil())
+			err = eve.AcceptInvitation("bob", invite, eveFile)
+			Expect(err).To(BeNil())
+
+			bobGrant := client.PermRead | client.PermAppend | client.PermReshare
+			expected := []client.Sharee{
+				{Username: "bob", SharedBy: "alice", Perms: bobGrant, Depth: client.UnlimitedReshare, Status: client.StatusAccepted},
+				{Username: "doris", SharedBy: "bob", Perms: client.PermRead | client.PermAppend, Depth: 0, Status: client.StatusPending},
+				{Username: "eve", SharedBy: "bob", Perms: bobGrant, Depth: client.UnlimitedReshare, Status: client.StatusAccepted},
+				{Username: "charles", SharedBy: "alice", Perms: client.PermRead, Depth: client.UnlimitedReshare, Status: client.StatusPending},
+			}
+			sharees, err = alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(Equal(expected))
+
+			userlib.DebugMsg("Bob sees his own subtree.")
+			sharees, err = bob.ListSharees(bobFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(Equal(expected[1:3]))
+
+			userlib.DebugMsg("Doris accepts, and Bob revokes Eve.")
+			err = doris.AcceptInvitation("bob", dorisInvite, dorisFile)
+			Expect(err).To(BeNil())
+			err = bob.RevokeAccess(bobFile, "eve")
+			Expect(err).To(BeNil())
+
+			expected[1].Status = client.StatusAccepted
+			sharees, err = alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(Equal([]client.Sharee{expected[0], expected[1], expected[3]}))
+
+			_, err = alice.ListSharees(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("A subtree that can't be verified is reported and skipped", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			var bobs []userlib.UUID
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					bobs = append(bobs, key)
+				}
+			}
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			_, err = bob.CreateInvitation(bobFile, "doris")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Everything Alice's invitation made for Bob is tampered with.")
+			for _, key := range bobs {
+				if _, ok := userlib.DatastoreGet(key); ok {
+					userlib.DatastoreSet(key, []byte("tampered"))
+				}
+			}
+
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(2))
+			Expect(sharees[0]).To(Equal(client.Sharee{Username: "bob", SharedBy: "alice", Status: client.StatusInvalid}))
+			Expect(sharees[1].Username).To(Equal("charles"))
+			Expect(sharees[1].Status).To(Equal(client.StatusPending))
+		})
+
+		Specify("An invitation that is gone was not necessarily accepted", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Someone deletes the invitation before Bob gets to it.")
+			userlib.DatastoreDelete(invite)
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(1))
+			Expect(sharees[0].Status).To(Equal(client.StatusUnknown))
+		})
+	})
+
+	Describe("Invitation Cancellation Tests", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A cancelled invitation cannot be accepted", func() {
+			content := strings.Repeat(contentOne, 1000)
+			err = alice.StoreFile(aliceFile, []byte(content))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(1))
+			Expect(sharees[0].Status).To(Equal(client.StatusPending))
+
+			bw := measureBandwidth(func() {
+				err = alice.CancelInvitation(aliceFile, "bob")
+			})
+			Expect(err).To(BeNil())
+			Expect(bw).To(BeNumerically("<", len(content)))
+
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(Equal(client.ErrInvitationCancelled))
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			sharees, err = alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(BeEmpty())
+
+			userlib.DebugMsg("Cancelling again, or an invitation never made, fails.")
+			Expect(alice.CancelInvitation(aliceFile, "bob")).To(Equal(client.ErrNoInvitation))
+			Expect(alice.CancelInvitation(aliceFile, "charles")).To(Equal(client.ErrNoInvitation))
+
+			userlib.DebugMsg("Bob can be invited again.")
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(content)))
+		})
+
+		Specify("Only the sender can cancel, and only before acceptance", func() {
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			Expect(alice.CancelInvitation(aliceFile, "bob")).To(Equal(client.ErrInvitationAccepted))
+
+			charlesInvite, err := bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			Expect(alice.CancelInvitation(aliceFile, "charles")).To(Equal(client.ErrNoInvitation))
+			Expect(bob.CancelInvitation(bobFile, "charles")).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", charlesInvite, charlesFile)).To(Equal(client.ErrInvitationCancelled))
+
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+
+	Describe("Invitation Expiry Tests", func() {
+
+		var clock *client.FakeClock
+		var restoreClock func()
+
+		BeforeEach(func() {
+			clock, restoreClock = client.UseFakeClock()
+
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			restoreClock()
+		})
+
+		Specify("An invitation can be accepted until its deadline only", func() {
+			deadline := client.WithInvitationExpiry(clock.In(60))
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob", deadline)
+			Expect(err).To(BeNil())
+			clock.Advance(59)
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			invite, err = alice.CreateInvitation(aliceFile, "charles", deadline)
+			Expect(err).To(BeNil())
+			clock.Advance(2)
+			Expect(charles.AcceptInvitation("alice", invite, charlesFile)).To(Equal(client.ErrInvitationExpired))
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Acceptance before the deadline still counts afterwards.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Cleanup removes expired invitations and everything made for them", func() {
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob", client.WithInvitationExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			_, err = bob.CreateInvitation(bobFile, "charles", client.WithInvitationExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "doris", client.WithInvitationExpiry(clock.In(180)))
+			Expect(err).To(BeNil())
+
+			removed, err := alice.CleanupInvitations(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(removed).To(BeEmpty())
+
+			clock.Advance(120)
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			statuses := make(map[string]client.InviteStatus)
+			for _, sharee := range sharees {
+				statuses[sharee.Username] = sharee.Status
+			}
+			Expect(statuses).To(Equal(map[string]client.InviteStatus{
+				"bob": client.StatusAccepted, "charles": client.StatusExpired, "doris": client.StatusPending,
+			}))
+
+			removed, err = alice.CleanupInvitations(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(removed).To(Equal([]string{"charles"}))
+
+			clock.Advance(120)
+			removed, err = alice.CleanupInvitations(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(removed).To(Equal([]string{"doris"}))
+
+			userlib.DebugMsg("Only Bob's share is left: his NodeKey, filename index, journal, node, owner record, grants, ShareMap and accept marker, and the inboxes, notes and note counts.")
+			after := userlib.DatastoreGetMap()
+			for key := range before {
+				Expect(after).To(HaveKey(key))
+			}
+			Expect(len(after)).To(Equal(len(before) + 17))
+		})
+
+		Specify("Cleanup keeps going past a sharee it can't read", func() {
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			_, err := alice.CreateInvitation(aliceFile, "bob", client.WithInvitationExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					userlib.DatastoreSet(key, []byte("tampered"))
+				}
+			}
+			_, err = alice.CreateInvitation(aliceFile, "doris", client.WithInvitationExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+
+			clock.Advance(120)
+			removed, err := alice.CleanupInvitations(aliceFile)
+			Expect(err).ToNot(BeNil())
+			Expect(removed).To(Equal([]string{"doris"}))
+		})
+	})
+
+	Describe("Access Expiry Tests", func() {
+
+		var clock *client.FakeClock
+		var restoreClock func()
+
+		BeforeEach(func() {
+			clock, restoreClock = client.UseFakeClock()
+
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			restoreClock()
+		})
+
+		Specify("A contractor's access ends at the sweep after its deadline", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob", client.WithAccessExpiry(clock.In(1440)))
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, dorisFile)
+			Expect(err).To(BeNil())
+
+			err = alice.EnforceExpirations()
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			clock.Advance(1440)
+			err = alice.EnforceExpirations()
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err = doris.LoadFile(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(1))
+			Expect(sharees[0].Username).To(Equal("doris"))
+		})
+
+		Specify("Reshares inherit the deadline and cannot extend it", func() {
+			deadline := clock.In(60)
+			invite, err := alice.CreateInvitation(aliceFile, "bob", client.WithAccessExpiry(deadline))
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			_, err = bob.CreateInvitation(bobFile, "charles", client.WithAccessExpiry(clock.In(61)))
+			Expect(err).To(Equal(client.ErrPermissionDenied))
+
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(2))
+			Expect(sharees[1].Username).To(Equal("charles"))
+			Expect(sharees[1].Until.Equal(deadline)).To(BeTrue())
+
+			userlib.DebugMsg("An invitation whose access has already ended cannot be accepted.")
+			invite, err = alice.CreateInvitation(aliceFile, "doris", client.WithAccessExpiry(clock.In(1)))
+			Expect(err).To(BeNil())
+			clock.Advance(2)
+			Expect(doris.AcceptInvitation("alice", invite, dorisFile)).To(Equal(client.ErrInvitationExpired))
+
+			clock.Advance(60)
+			err = alice.EnforceExpirations()
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("A grantee cannot make its grant permanent by tampering with its blobs", func() {
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(bobFile, "charles", client.WithAccessExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			invite, err = alice.CreateInvitation(aliceFile, "bob", client.WithAccessExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob garbles everything that was made for him.")
+			for key, value := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					before[key] = true
+					value[len(value)-1] ^= 1
+					userlib.DatastoreSet(key, value)
+				}
+			}
+
+			clock.Advance(60)
+			err = alice.EnforceExpirations()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob is cut off, and Charles's grant on the other file expired as well.")
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(BeEmpty())
+			sharees, err = alice.ListSharees(bobFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(BeEmpty())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("A sharee enforces the deadlines of their own grants", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles", client.WithAccessExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			clock.Advance(60)
+			err = bob.EnforceExpirations()
+			Expect(err).To(BeNil())
+
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+	})
+
+	Describe("Invitation Details Tests", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("The recipient can see what an invitation is for before accepting it", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob",
+				client.WithPermissions(client.PermAppend), client.WithMessage("the minutes, please add yours"))
+			Expect(err).To(BeNil())
+
+			details, err := bob.InspectInvitation("alice", invite)
+			Expect(err).To(BeNil())
+			Expect(details).To(Equal(client.InvitationDetails{
+				Filename: aliceFile,
+				Size:     len(contentOne + contentTwo),
+				Perms:    client.PermRead | client.PermAppend,
+				Message:  "the minutes, please add yours",
+			}))
+
+			userlib.DebugMsg("Inspecting leaves the invitation to be accepted under any name.")
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			_, err = bob.InspectInvitation("alice", invite)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Only the recipient can read an invitation, and only from its sender", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob", client.WithMessage("for bob"))
+			Expect(err).To(BeNil())
+
+			_, err = charles.InspectInvitation("alice", invite)
+			Expect(err).ToNot(BeNil())
+			_, err = bob.InspectInvitation("charles", invite)
+			Expect(err).ToNot(BeNil())
+
+			datastore := userlib.DatastoreGetMap()
+			invitation := datastore[invite]
+			invitation[len(invitation)-1] ^= 1
+			userlib.DatastoreSet(invite, invitation)
+			_, err = bob.InspectInvitation("alice", invite)
+			Expect(err).ToNot(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).ToNot(BeNil())
+		})
+
+		Specify("An invitation can carry more than one RSA block", func() {
+			message := strings.Repeat("a long note about the file. ", 200)
+			invite, err := alice.CreateInvitation(aliceFile, "bob", client.WithMessage(message))
+			Expect(err).To(BeNil())
+
+			details, err := bob.InspectInvitation("alice", invite)
+			Expect(err).To(BeNil())
+			Expect(details.Message).To(Equal(message))
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Malformed invitations are rejected without panicking", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			invitation := append([]byte{}, userlib.DatastoreGetMap()[invite]...)
+
+			malformed := [][]byte{
+				{},
+				invitation[:1],
+				invitation[:3],
+				invitation[:len(invitation)-1],
+				append([]byte{invitation[0] + 1}, invitation[1:]...),
+				append([]byte{invitation[0], 0xff, 0xff, 0xff, 0xff}, invitation[5:]...),
+				append(append([]byte{}, invitation...), 0, 0, 0, 0),
+				userlib.RandomBytes(200),
+			}
+			for _, data := range malformed {
+				userlib.DatastoreSet(invite, data)
+				_, err = bob.InspectInvitation("alice", invite)
+				Expect(err).ToNot(BeNil())
+				Expect(bob.AcceptInvitation("alice", invite, bobFile)).ToNot(BeNil())
+			}
+
+			userlib.DatastoreSet(invite, invitation)
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("An invitation only opens at its own pointer, for its own recipient", func() {
+			err = alice.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			other, err := alice.CreateInvitation(bobFile, "bob")
+			Expect(err).To(BeNil())
+			forCharles, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			datastore := userlib.DatastoreGetMap()
+			invitation := append([]byte{}, datastore[invite]...)
+			otherInvitation := append([]byte{}, datastore[other]...)
+
+			userlib.DebugMsg("Bob's invitation moved to another of his pointers.")
+			userlib.DatastoreSet(other, invitation)
+			_, err = bob.InspectInvitation("alice", other)
+			Expect(err).ToNot(BeNil())
+			Expect(bob.AcceptInvitation("alice", other, bobFile)).ToNot(BeNil())
+
+			userlib.DebugMsg("Charles's invitation moved to Bob's pointer.")
+			userlib.DatastoreSet(invite, datastore[forCharles])
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).ToNot(BeNil())
+
+			userlib.DatastoreSet(invite, invitation)
+			userlib.DatastoreSet(other, otherInvitation)
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", forCharles, charlesFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A handover only opens at its own pointer", func() {
+			err = alice.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			handover, err := alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			other, err := alice.CreateInvitation(bobFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DatastoreSet(other, userlib.DatastoreGetMap()[handover])
+			Expect(bob.AcceptOwnership("alice", other, bobFile)).ToNot(BeNil())
+
+			err = bob.AcceptOwnership("alice", handover, bobFile)
+			Expect(err).To(BeNil())
+			owner, err := alice.FileOwner(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("bob"))
+		})
+	})
+
+	Describe("Inbox Tests", func() {
+
+		var clock *client.FakeClock
+		var restoreClock func()
+
+		BeforeEach(func() {
+			clock, restoreClock = client.UseFakeClock()
+
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = charles.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			restoreClock()
+		})
+
+		Specify("Invitations show up in the recipient's inbox until accepted", func() {
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+
+			fromAlice, err := alice.CreateInvitation(aliceFile, "bob", client.WithMessage("hi bob"))
+			Expect(err).To(BeNil())
+			fromCharles, err := charles.CreateInvitation(charlesFile, "bob", client.WithPermissions(client.PermRead))
+			Expect(err).To(BeNil())
+
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]client.InboxEntry{
+				{Sender: "alice", InvitationPtr: fromAlice, Details: client.InvitationDetails{
+					Filename: aliceFile, Size: len(contentOne), Perms: client.PermAll, Message: "hi bob"}},
+				{Sender: "charles", InvitationPtr: fromCharles, Details: client.InvitationDetails{
+					Filename: charlesFile, Size: len(contentTwo), Perms: client.PermRead}},
+			}))
+
+			none, err := charles.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(none).To(BeEmpty())
+
+			userlib.DebugMsg("Bob accepts straight from his inbox.")
+			err = bob.AcceptInvitation(entries[0].Sender, entries[0].InvitationPtr, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].InvitationPtr).To(Equal(fromCharles))
+		})
+
+		Specify("Cancelled and expired invitations leave the inbox", func() {
+			_, err := alice.CreateInvitation(aliceFile, "bob", client.WithInvitationExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			_, err = charles.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+
+			err = charles.CancelInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Sender).To(Equal("alice"))
+
+			clock.Advance(120)
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+		})
+
+		Specify("Notes the sender did not sign are ignored and what they point to is kept", func() {
+			fromAlice, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			inbox, err := client.DeriveUuid(userlib.Hash([]byte("bob"))[:16], "Inbox")
+			Expect(err).To(BeNil())
+			stored_inbox, ok := userlib.DatastoreGet(inbox)
+			Expect(ok).To(BeTrue())
+			genuine := strings.Trim(string(stored_inbox), `[]"`)
+			var note []byte
+			for key, value := range userlib.DatastoreGetMap() {
+				if key.String() == genuine {
+					note = value
+				}
+			}
+			Expect(note).ToNot(BeNil())
+
+			userlib.DebugMsg("Charles lists a copy of Alice's note, a garbled one, and Alice's invitation itself.")
+			copied, err := client.DeriveUuid(userlib.RandomBytes(16), "copy")
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(copied, note)
+			garbled, err := client.DeriveUuid(userlib.RandomBytes(16), "garbled")
+			Expect(err).To(BeNil())
+			bad := append([]byte{}, note...)
+			bad[len(bad)-1] ^= 0xff
+			userlib.DatastoreSet(garbled, bad)
+			userlib.DatastoreSet(inbox, []byte(`["`+genuine+`","`+copied.String()+`","`+garbled.String()+`","`+fromAlice.String()+`"]`))
+
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].InvitationPtr).To(Equal(fromAlice))
+
+			stored_inbox, ok = userlib.DatastoreGet(inbox)
+			Expect(ok).To(BeTrue())
+			Expect(string(stored_inbox)).To(Equal(`["` + genuine + `"]`))
+			_, ok = userlib.DatastoreGet(copied)
+			Expect(ok).To(BeTrue())
+
+			err = bob.AcceptInvitation("alice", fromAlice, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Notes dropped from the inbox are found again, and notes deleted are reported", func() {
+			inbox, err := client.DeriveUuid(userlib.Hash([]byte("bob"))[:16], "Inbox")
+			Expect(err).To(BeNil())
+			listed := func() []string {
+				stored_inbox, ok := userlib.DatastoreGet(inbox)
+				Expect(ok).To(BeTrue())
+				return strings.Split(strings.Trim(string(stored_inbox), "[]"), ",")
+			}
+			ptrs := func(entries []client.InboxEntry) (ptrs []userlib.UUID) {
+				for _, entry := range entries {
+					ptrs = append(ptrs, entry.InvitationPtr)
+				}
+				return ptrs
+			}
+
+			first, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			firstNote := strings.Trim(listed()[0], `"`)
+
+			clock.Advance(1)
+			fromCharles, err := charles.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			clock.Advance(1)
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			second, err := alice.CreateInvitation(bobFile, "bob")
+			Expect(err).To(BeNil())
+			clock.Advance(1)
+			err = alice.StoreFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			third, err := alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Charles rewrites the inbox to list Alice's third note before his own, and nothing else.")
+			notes := listed()
+			Expect(notes).To(HaveLen(4))
+			userlib.DatastoreSet(inbox, []byte("["+notes[3]+","+notes[1]+"]"))
+
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(ptrs(entries)).To(Equal([]userlib.UUID{first, fromCharles, second, third}))
+			Expect(listed()).To(HaveLen(4))
+
+			userlib.DebugMsg("Charles deletes Alice's first note.")
+			for key := range userlib.DatastoreGetMap() {
+				if key.String() == firstNote {
+					userlib.DatastoreDelete(key)
+				}
+			}
+			entries, err = bob.ListInvitations()
+			Expect(err).To(MatchError(client.ErrNoteRemoved))
+			Expect(ptrs(entries)).To(Equal([]userlib.UUID{fromCharles, second, third}))
+
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+		})
+	})
+
+	Describe("Group Tests", func() {
+
+		team := client.GroupRecipient("doris", "team")
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = doris.CreateGroup("team", []string{"bob", "charles"})
+			Expect(err).To(BeNil())
+		})
+
+		Specify("One invitation shares a file with every member", func() {
+			invite, err := alice.CreateInvitation(aliceFile, team, client.WithMessage("for the team"))
+			Expect(err).To(BeNil())
+
+			entries, err := bob.ListGroupInvitations("doris", "team")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Sender).To(Equal("alice"))
+			Expect(entries[0].InvitationPtr).To(Equal(invite))
+			Expect(entries[0].Details.Message).To(Equal("for the team"))
+			Expect(entries[0].Details.Perms & client.PermReshare).To(BeZero())
+
+			err = bob.AcceptGroupInvitation("doris", "team", "alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptGroupInvitation("doris", "team", "alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Only members can accept, and members cannot reshare.")
+			_, err = alice.ListGroupInvitations("doris", "team")
+			Expect(err).To(Equal(client.ErrNotGroupMember))
+			Expect(alice.AcceptGroupInvitation("doris", "team", "alice", invite, bobFile)).ToNot(BeNil())
+			_, err = bob.CreateInvitation(bobFile, "alice")
+			Expect(err).ToNot(BeNil())
+
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(1))
+			Expect(sharees[0].Username).To(Equal(team))
+		})
+
+		Specify("Neither the group nor its invitations name anyone in the clear", func() {
+			invite, err := alice.CreateInvitation(aliceFile, team)
+			Expect(err).To(BeNil())
+
+			groupUuid, err := client.DeriveUuid(userlib.Hash([]byte(team))[:16], "Group")
+			Expect(err).To(BeNil())
+			stored_group, ok := userlib.DatastoreGet(groupUuid)
+			Expect(ok).To(BeTrue())
+			stored_invite, ok := userlib.DatastoreGet(invite)
+			Expect(ok).To(BeTrue())
+			for _, name := range []string{"alice", "charles", "doris", "team", `"bob"`} {
+				Expect(string(stored_group)).ToNot(ContainSubstring(name))
+				Expect(string(stored_invite)).ToNot(ContainSubstring(name))
+			}
+
+			entries, err := charles.ListGroupInvitations("doris", "team")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Sender).To(Equal("alice"))
+			Expect(bob.AcceptGroupInvitation("doris", "team", "doris", invite, bobFile)).ToNot(BeNil())
+			err = bob.AcceptGroupInvitation("doris", "team", "alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A group's grant is accepted once a member accepts it", func() {
+			invite, err := alice.CreateInvitation(aliceFile, team)
+			Expect(err).To(BeNil())
+
+			status := func() client.InviteStatus {
+				sharees, err := alice.ListSharees(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(sharees).To(HaveLen(1))
+				return sharees[0].Status
+			}
+			Expect(status()).To(Equal(client.StatusPending))
+
+			err = bob.AcceptGroupInvitation("doris", "team", "alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			Expect(status()).To(Equal(client.StatusAccepted))
+			Expect(alice.CancelInvitation(aliceFile, team)).To(Equal(client.ErrInvitationAccepted))
+
+			userlib.DebugMsg("A group invitation nobody accepted can be cancelled.")
+			err = alice.StoreFile(dorisFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(dorisFile, team)
+			Expect(err).To(BeNil())
+			Expect(alice.CancelInvitation(dorisFile, team)).To(BeNil())
+			Expect(charles.AcceptGroupInvitation("doris", "team", "alice", invite, charlesFile)).ToNot(BeNil())
+		})
+
+		Specify("Re-keying a group without a member re-keys only the group", func() {
+			invite, err := alice.CreateInvitation(aliceFile, team)
+			Expect(err).To(BeNil())
+			err = bob.AcceptGroupInvitation("doris", "team", "alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = charles.AcceptGroupInvitation("doris", "team", "alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+
+			Expect(bob.RekeyGroupWithout("team", "charles")).To(Equal(client.ErrNoSuchGroup))
+
+			snapshot := func() map[userlib.UUID][]byte {
+				kept := make(map[userlib.UUID][]byte)
+				for key, value := range userlib.DatastoreGetMap() {
+					kept[key] = append([]byte{}, value...)
+				}
+				return kept
+			}
+			before := snapshot()
+			err = doris.RekeyGroupWithout("team", "charles")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Only the group and its invitation changed, and Doris has a journal now.")
+			after := snapshot()
+			Expect(after).To(HaveLen(len(before) + 1))
+			changed := 0
+			for key, value := range before {
+				if string(after[key]) != string(value) {
+					changed++
+				}
+			}
+			Expect(changed).To(Equal(2))
+
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+			charlesAgain, err := client.GetUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = charlesAgain.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("A new member can accept what was shared before they joined.")
+			err = doris.AddGroupMember("team", "charles")
+			Expect(err).To(BeNil())
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Revoking the group cuts off every member", func() {
+			invite, err := alice.CreateInvitation(aliceFile, team)
+			Expect(err).To(BeNil())
+			err = bob.AcceptGroupInvitation("doris", "team", "alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, team)
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			Expect(charles.AcceptGroupInvitation("doris", "team", "alice", invite, charlesFile)).ToNot(BeNil())
+
+			Expect(doris.CreateGroup("team", nil)).To(Equal(client.ErrGroupExists))
+			_, err = client.InitUser(team, defaultPassword)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("A group is found by its admin as well as its name", func() {
+			err = charles.CreateGroup("team", nil)
+			Expect(err).To(BeNil())
+			entries, err := charles.ListGroupInvitations("charles", "team")
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+
+			userlib.DebugMsg("Charles puts his own team where Doris's is stored.")
+			location := func(admin string) userlib.UUID {
+				groupUuid, err := client.DeriveUuid(userlib.Hash([]byte(client.GroupRecipient(admin, "team")))[:16], "Group")
+				Expect(err).To(BeNil())
+				return groupUuid
+			}
+			stored_group, ok := userlib.DatastoreGet(location("charles"))
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(location("doris"), stored_group)
+
+			_, err = alice.CreateInvitation(aliceFile, team)
+			Expect(err).ToNot(BeNil())
+			_, err = charles.ListGroupInvitations("doris", "team")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Share Link Tests", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Anyone with a link can read the file as it changes", func() {
+			token, err := alice.CreateShareLink(aliceFile)
+			Expect(err).To(BeNil())
+
+			data, err := client.LoadFromLink(token)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = client.LoadFromLink(token)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(2))
+			Expect(sharees[1].Username).To(HavePrefix("link:"))
+			Expect(sharees[1].Perms).To(Equal(client.PermRead))
+
+			for _, bad := range []string{"", "zz", token[:30], strings.Repeat("0", 32)} {
+				_, err = client.LoadFromLink(bad)
+				Expect(err).ToNot(BeNil())
+			}
+		})
+
+		Specify("Revoking a link rotates the keys so it stops working", func() {
+			token, err := alice.CreateShareLink(aliceFile)
+			Expect(err).To(BeNil())
+			other, err := bob.CreateShareLink(bobFile)
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeShareLink(aliceFile, token)
+			Expect(err).To(BeNil())
+			_, err = client.LoadFromLink(token)
+			Expect(err).ToNot(BeNil())
+			Expect(alice.RevokeShareLink(aliceFile, token)).To(Equal(client.ErrNotInSubtree))
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := client.LoadFromLink(other)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Bob revokes his own link.")
+			err = bob.RevokeShareLink(bobFile, other)
+			Expect(err).To(BeNil())
+			_, err = client.LoadFromLink(other)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Only users who may reshare can create links", func() {
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles", client.WithReshareDepth(0))
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			_, err = charles.CreateShareLink(charlesFile)
+			Expect(err).To(Equal(client.ErrPermissionDenied))
+		})
+	})
+
+	Describe("Key Rotation Tests", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("New keys are published under the next version and the old ones stay", func() {
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+
+			keystore := userlib.KeystoreGetMap()
+			for _, name := range []string{"bob_Public", "bob_Verify", "bob_Public_v2", "bob_Verify_v2", "bob_Public_v3", "bob_Verify_v3"} {
+				Expect(keystore).To(HaveKey(name))
+			}
+			Expect(keystore).ToNot(HaveKey("bob_Public_v4"))
+
+			userlib.DebugMsg("A stale session cannot claim a version already taken.")
+			stale, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			Expect(stale.RotateKeys()).ToNot(BeNil())
+		})
+
+		Specify("Sharing keeps working across a rotation", func() {
+			pending, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("What was signed and sealed with the old keys still opens.")
+			err = bob.AcceptInvitation("alice", pending, bobFile)
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("What is signed and sealed with the new keys opens after logging in again.")
+			err = bob.StoreFile(bobFile+"2", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile+"2", "alice")
+			Expect(err).To(BeNil())
+			aliceAgain, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceAgain.AcceptInvitation("bob", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err = aliceAgain.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree)))
+		})
+
+		Specify("A rotation while the same session shares and reads", func() {
+			const workers = 4
+
+			userlib.DebugMsg("Rotating Alice's keys while her session invites, loads and lists at once.")
+			done := make(chan error)
+			go func() {
+				done <- alice.RotateKeys()
+			}()
+			for i := 0; i < workers; i++ {
+				go func(i int) {
+					_, err := alice.CreateInvitation(aliceFile, "bob")
+					// signing with the old keys may lose to the rotation
+					if err == client.ErrStaleSession {
+						err = nil
+					}
+					if err == nil {
+						_, err = alice.LoadFile(aliceFile)
+					}
+					if err == nil {
+						_, err = alice.ListInvitations()
+					}
+					done <- err
+				}(i)
+			}
+			for i := 0; i <= workers; i++ {
+				Expect(<-done).To(BeNil())
+			}
+
+			userlib.DebugMsg("Afterwards the session signs with the new keys.")
+			Expect(alice.KeyVersion).To(Equal(2))
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Everything signed with the old keys is signed again", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			pending, err := bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = alice.CreateGroup("team", []string{"bob"})
+			Expect(err).To(BeNil())
+			shared, err := alice.CreateInvitation(aliceFile, client.GroupRecipient("alice", "team"))
+			Expect(err).To(BeNil())
+
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The owner record, grants, accept marker and group still verify.")
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(HaveLen(3))
+			for _, sharee := range sharees {
+				Expect(sharee.Status).ToNot(Equal(client.StatusInvalid), sharee.Username)
+			}
+			Expect(sharees[0].Username).To(Equal("bob"))
+			Expect(sharees[0].Status).To(Equal(client.StatusAccepted))
+
+			userlib.DebugMsg("So do the invitation for the group and Bob's pending invitation and its note.")
+			entries, err := bob.ListGroupInvitations("alice", "team")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].InvitationPtr).To(Equal(shared))
+
+			entries, err = charles.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].InvitationPtr).To(Equal(pending))
+			err = charles.AcceptInvitation("bob", pending, charlesFile)
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("What an old key signs after the rotation is rejected", func() {
+			stolen, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			before, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			replayed, ok := userlib.DatastoreGet(before)
+			Expect(ok).To(BeTrue())
+
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("A session with the old keys can no longer sign.")
+			_, err = stolen.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(Equal(client.ErrStaleSession))
+
+			userlib.DebugMsg("The invitation as the old key signed it is rejected, whenever it was signed.")
+			resigned, ok := userlib.DatastoreGet(before)
+			Expect(ok).To(BeTrue())
+			Expect(resigned).ToNot(Equal(replayed))
+			userlib.DatastoreSet(before, replayed)
+			Expect(bob.AcceptInvitation("alice", before, bobFile)).ToNot(BeNil())
+			userlib.DatastoreSet(before, resigned)
+
+			userlib.DebugMsg("With the record of the rotation deleted, nothing of Alice's verifies.")
+			recordUuid, err := client.DeriveUuid(userlib.Hash([]byte("alice"))[:16], "Keys v2")
+			Expect(err).To(BeNil())
+			record, ok := userlib.DatastoreGet(recordUuid)
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreDelete(recordUuid)
+			_, err = stolen.CreateInvitation(aliceFile, "charles")
+			Expect(err).ToNot(BeNil())
+			Expect(bob.AcceptInvitation("alice", before, bobFile)).ToNot(BeNil())
+			userlib.DatastoreSet(recordUuid, record)
+
+			err = bob.AcceptInvitation("alice", before, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Someone else's keys under the next version hold the user up until they rotate past them", func() {
+			publicKey, _, err := userlib.PKEKeyGen()
+			Expect(err).To(BeNil())
+			_, verifyKey, err := userlib.DSKeyGen()
+			Expect(err).To(BeNil())
+			Expect(userlib.KeystoreSet("alice_Verify_v2", verifyKey)).To(BeNil())
+			Expect(userlib.KeystoreSet("alice_Public_v2", publicKey)).To(BeNil())
+
+			userlib.DebugMsg("Nothing is sealed to the squatted keys, and Alice can't sign.")
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = bob.CreateInvitation(bobFile, "alice")
+			Expect(err).ToNot(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).ToNot(BeNil())
+
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			Expect(alice.KeyVersion).To(Equal(3))
+			invite, err := bob.CreateInvitation(bobFile, "alice")
+			Expect(err).To(BeNil())
+			err = alice.AcceptInvitation("bob", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A rotation waits for a file handed over to be accepted", func() {
+			invite, err := alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(alice.RotateKeys()).To(Equal(client.ErrTransferPending))
+
+			err = bob.AcceptOwnership("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			owner, err := alice.FileOwner(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(owner).To(Equal("bob"))
+		})
+	})
+
+	Describe("Filename Key Rotation Tests", func() {
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Every file moves to the new key and nothing is left under the old one", func() {
+			err = alice.StoreFile(aliceFile+"2", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := bob.CreateInvitation(bobFile, "alice")
+			Expect(err).To(BeNil())
+			err = alice.AcceptInvitation("bob", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.DeleteFile(charlesFile)
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+
+			err = alice.RotateFilenameKey()
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Three NodeKeys, the index and the journal index are gone; three NodeKeys and the index are new.")
+			after := userlib.DatastoreGetMap()
+			gone := 0
+			for key := range before {
+				if _, ok := after[key]; !ok {
+					gone++
+				}
+			}
+			Expect(gone).To(Equal(5))
+			Expect(len(after)).To(Equal(len(before) - 1))
+
+			for _, user := range []*client.User{alice, nil} {
+				if user == nil {
+					user, err = client.GetUser("alice", defaultPassword)
+					Expect(err).To(BeNil())
+				}
+				data, err := user.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+				data, err = user.LoadFile(aliceFile + "2")
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentTwo)))
+				data, err = user.LoadFile(bobFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentTwo)))
+				_, err = user.LoadFile(charlesFile)
+				Expect(err).ToNot(BeNil())
+			}
+		})
+
+		Specify("Files keep working after a rotation", func() {
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			err = alice.RotateFilenameKey()
+			Expect(err).To(BeNil())
+			err = alice.RotateFilenameKey()
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invite, aliceFile)
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Files stored after the rotation survive the next one.")
+			err = alice.StoreFile(aliceFile+"2", []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.RotateFilenameKey()
+			Expect(err).To(BeNil())
+			aliceAgain, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = aliceAgain.LoadFile(aliceFile + "2")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Expiry schedules move with the files", func() {
+			clock, restoreClock := client.UseFakeClock()
+			defer restoreClock()
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob", client.WithAccessExpiry(clock.In(60)))
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, aliceFile)
+			Expect(err).To(BeNil())
+
+			err = alice.RotateFilenameKey()
+			Expect(err).To(BeNil())
+
+			clock.Advance(120)
+			err = alice.EnforceExpirations()
+			Expect(err).To(BeNil())
+			sharees, err := alice.ListSharees(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(sharees).To(BeEmpty())
+		})
+
+		Specify("Files from before the index must be indexed before a rotation", func() {
+			userlib.DebugMsg("Alice's user and files are made to look older than the index.")
+			indexKey, err := userlib.HashKDF(alice.FilenameKey, []byte("FileIndex"))
+			Expect(err).To(BeNil())
+			indexUuid, err := client.DeriveUuid(indexKey[:16], "FileIndex")
+			Expect(err).To(BeNil())
+			userlib.DatastoreDelete(indexUuid)
+
+			userKey := userlib.Argon2Key([]byte(defaultPassword), userlib.Hash([]byte("alice")), 16)
+			userUuid, err := client.DeriveUuid(userKey, "UUID")
+			Expect(err).To(BeNil())
+			stored_user, ok := userlib.DatastoreGet(userUuid)
+			Expect(ok).To(BeTrue())
+			userBytes, err := client.AuthDec(userKey, stored_user)
+			Expect(err).To(BeNil())
+			userBytes = []byte(strings.Replace(string(userBytes), `"Indexed":true`, `"Indexed":false`, 1))
+			stored_user, err = client.AuthEnc(userKey, userBytes)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(userUuid, stored_user)
+
+			old, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(old.RotateFilenameKey()).To(Equal(client.ErrUnindexedFiles))
+			Expect(old.EnableRandomNodeKeyLocations()).To(Equal(client.ErrUnindexedFiles))
+
+			err = old.IndexFilenames([]string{aliceFile, "never stored"})
+			Expect(err).To(BeNil())
+			err = old.RotateFilenameKey()
+			Expect(err).To(BeNil())
+
+			aliceAgain, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := aliceAgain.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+	})
+
+	Describe("Access Pattern Tests", func() {
+
+		// touched returns the key of every Datastore access op makes.
+		touched := func(op func()) map[userlib.UUID]bool {
+			recording := &recordingStorage{keys: make(map[userlib.UUID]bool)}
+			recording.Storage = client.SetStorage(recording)
+			defer client.SetStorage(recording.Storage)
+			op()
+			return recording.keys
+		}
+
+		// loaded returns the keys a new session of username touches loading
+		// filename, and whether the load succeeded.
+		loaded := func(username string, filename string) (keys map[userlib.UUID]bool, ok bool) {
+			user, err := client.GetUser(username, defaultPassword)
+			Expect(err).To(BeNil())
+			keys = touched(func() {
+				_, err = user.LoadFile(filename)
+			})
+			return keys, err == nil
+		}
+
+		minus := func(keys map[userlib.UUID]bool, other map[userlib.UUID]bool) (left []userlib.UUID) {
+			for key := range keys {
+				if !other[key] {
+					left = append(left, key)
+				}
+			}
+			return left
+		}
+
+		absent := func(keys map[userlib.UUID]bool) []userlib.UUID {
+			stored := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				stored[key] = true
+			}
+			return minus(keys, stored)
+		}
+
+		BeforeEach(func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("By default every access to a filename touches the same location", func() {
+			first, ok := loaded("alice", aliceFile)
+			Expect(ok).To(BeTrue())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			second, ok := loaded("alice", aliceFile)
+			Expect(ok).To(BeTrue())
+			Expect(minus(first, second)).To(BeEmpty())
+
+			userlib.DebugMsg("A filename that is not there is looked up at the same location every time.")
+			missing, ok := loaded("alice", bobFile)
+			Expect(ok).To(BeFalse())
+			again, ok := loaded("alice", bobFile)
+			Expect(ok).To(BeFalse())
+			Expect(absent(missing)).To(HaveLen(1))
+			Expect(absent(again)).To(Equal(absent(missing)))
+
+			userlib.DebugMsg("The same filename of another user has nothing in common with it.")
+			err = bob.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			bobs, ok := loaded("bob", aliceFile)
+			Expect(ok).To(BeTrue())
+			Expect(minus(bobs, second)).To(HaveLen(len(bobs)))
+		})
+
+		Specify("Random locations move a NodeKey only when asked to", func() {
+			derived, ok := loaded("alice", aliceFile)
+			Expect(ok).To(BeTrue())
+
+			err = alice.MoveNodeKeys()
+			Expect(err).To(Equal(client.ErrFixedLocations))
+			err = alice.EnableRandomNodeKeyLocations()
+			Expect(err).To(BeNil())
+
+			first, ok := loaded("alice", aliceFile)
+			Expect(ok).To(BeTrue())
+			moved := minus(derived, first)
+			Expect(moved).To(HaveLen(1))
+			Expect(absent(derived)).To(ContainElement(moved[0]))
+
+			userlib.DebugMsg("Writes and reads do not move it.")
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			second, ok := loaded("alice", aliceFile)
+			Expect(ok).To(BeTrue())
+			Expect(minus(first, second)).To(BeEmpty())
+
+			err = alice.MoveNodeKeys()
+			Expect(err).To(BeNil())
+			third, ok := loaded("alice", aliceFile)
+			Expect(ok).To(BeTrue())
+			moved = minus(second, third)
+			Expect(moved).To(HaveLen(1))
+			Expect(absent(second)).To(ContainElement(moved[0]))
+
+			userlib.DebugMsg("A filename that is not there is looked up somewhere new every time.")
+			missing, ok := loaded("alice", bobFile)
+			Expect(ok).To(BeFalse())
+			again, ok := loaded("alice", bobFile)
+			Expect(ok).To(BeFalse())
+			Expect(absent(missing)).To(HaveLen(1))
+			Expect(absent(again)).To(HaveLen(1))
+			Expect(absent(again)).ToNot(Equal(absent(missing)))
+		})
+
+		Specify("Moving NodeKeys leaves nothing behind", func() {
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.EnableRandomNodeKeyLocations()
+			Expect(err).To(BeNil())
+
+			before := len(userlib.DatastoreGetMap())
+			for i := 0; i < 3; i++ {
+				err = alice.MoveNodeKeys()
+				Expect(err).To(BeNil())
+			}
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before))
+		})
+
+		Specify("An append costs the same however many files there are", func() {
+			err = alice.EnableRandomNodeKeyLocations()
+			Expect(err).To(BeNil())
+
+			// the bytes stored at every key an append of a new session
+			// touches, after the session's first access
+			appendCost := func() (cost int) {
+				user, err := client.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				_, err = user.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				keys := touched(func() {
+					err = user.AppendToFile(aliceFile, []byte(contentTwo))
+				})
+				Expect(err).To(BeNil())
+				for key := range keys {
+					value, _ := userlib.DatastoreGet(key)
+					cost += len(value)
+				}
+				return cost
+			}
+
+			few := appendCost()
+			for i := 0; i < 20; i++ {
+				err = alice.StoreFile("file"+strconv.Itoa(i), []byte(contentOne))
+				Expect(err).To(BeNil())
+			}
+			Expect(appendCost()).To(Equal(few))
+		})
+
+		Specify("A rejected invitation leaves its filename free", func() {
+			err = alice.EnableRandomNodeKeyLocations()
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := bob.CreateInvitation(bobFile, "alice")
+			Expect(err).To(BeNil())
+
+			err = alice.AcceptInvitation("charles", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("The filename is still looked up somewhere new every time.")
+			missing, ok := loaded("alice", bobFile)
+			Expect(ok).To(BeFalse())
+			again, ok := loaded("alice", bobFile)
+			Expect(ok).To(BeFalse())
+			Expect(absent(again)).ToNot(Equal(absent(missing)))
+
+			err = alice.AcceptInvitation("bob", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Files keep working with random locations", func() {
+			err = alice.EnableRandomNodeKeyLocations()
+			Expect(err).To(BeNil())
+			err = bob.EnableRandomNodeKeyLocations()
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("A new filename can only be taken once.")
+			err = bob.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			err = alice.RotateFilenameKey()
+			Expect(err).To(BeNil())
+			aliceAgain, err := client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = aliceAgain.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			bobAgain, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err = bobAgain.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+
+			err = aliceAgain.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bobAgain.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A session finds a file another session stored again somewhere new.")
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			err = aliceAgain.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			_, err = aliceAgain.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = aliceAgain.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+	})
 })